@@ -0,0 +1,77 @@
+package connections
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ICEServer is a STUN or TURN server. URLs use the usual forms, e.g. "stun:host:3478",
+// "turn:host:3478?transport=tcp" or "turns:host:5349"; TURN servers need Username and Credential.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// ICEConfig selects how WebRTC peers gather candidates.
+type ICEConfig struct {
+	// Servers lists STUN/TURN servers. nil means DefaultICEServers; an empty list means none.
+	Servers []ICEServer `json:"iceServers"`
+	// Policy is "all" (default) or "relay" to use TURN relay candidates only.
+	Policy string `json:"policy,omitempty"`
+	// LANOnly gathers host candidates only and contacts no external server.
+	LANOnly bool `json:"lanOnly,omitempty"`
+}
+
+// DefaultICEServers is used when no servers are configured: one public STUN server and no TURN.
+var DefaultICEServers = []ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}}
+
+// LoadICEConfig reads an ICEConfig from a JSON file such as
+//
+//	{"iceServers": [{"urls": ["turn:turn.example.org:3478?transport=udp"], "username": "u", "credential": "p"}], "policy": "all"}
+func LoadICEConfig(path string) (ICEConfig, error) {
+	var c ICEConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, fmt.Errorf("ice config: %w", err)
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("ice config %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// configuration turns c into the Pion configuration for a new peer connection.
+func (c ICEConfig) configuration() (webrtc.Configuration, error) {
+	var cfg webrtc.Configuration
+	switch c.Policy {
+	case "", "all":
+		cfg.ICETransportPolicy = webrtc.ICETransportPolicyAll
+	case "relay":
+		cfg.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	default:
+		return cfg, fmt.Errorf("ice policy: unknown value %q (want all or relay)", c.Policy)
+	}
+	if c.LANOnly {
+		if cfg.ICETransportPolicy == webrtc.ICETransportPolicyRelay {
+			return cfg, fmt.Errorf("ice policy: relay cannot be combined with LAN-only mode")
+		}
+		// No servers at all: only host candidates are gathered and nothing leaves the LAN.
+		return cfg, nil
+	}
+	servers := c.Servers
+	if servers == nil {
+		servers = DefaultICEServers
+	}
+	for _, s := range servers {
+		cfg.ICEServers = append(cfg.ICEServers, webrtc.ICEServer{
+			URLs:       s.URLs,
+			Username:   s.Username,
+			Credential: s.Credential,
+		})
+	}
+	return cfg, nil
+}
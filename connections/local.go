@@ -2,66 +2,207 @@ package connections
 
 import (
 	"bufio"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	pcrypto "learnP2P/crypto"
 )
 
-const handshakeMagic = "P2P/1"
+const handshakeMagic = "P2P/2"
 
 // HandshakeMagic exposes the protocol marker used in local handshakes.
 func HandshakeMagic() string { return handshakeMagic }
 
-// ListenAndAcceptOnce listens on port and returns the first connection that completes
-// a valid password-protected handshake. The returned connection remains open for the caller.
-func ListenAndAcceptOnce(ourName string, port int, expectedPassword string) (net.Conn, string, error) {
+// ErrAuthFailed is returned when the SPAKE2 key confirmation does not match,
+// i.e. the passwords differ or someone tampered with the handshake.
+var ErrAuthFailed = errors.New("authentication failed: wrong password or tampered handshake")
+
+// AuthConn is a TCP connection that completed the password-authenticated handshake.
+// AuthKey returns the SPAKE2 key; transfer mixes it into its session key derivation so
+// a man in the middle cannot splice into the encrypted transfer.
+type AuthConn struct {
+	net.Conn
+	r   *bufio.Reader // the handshake's reader, which may hold what the peer sent right after it
+	key []byte
+}
+
+// AuthKey returns the key agreed during the password-authenticated handshake.
+func (c *AuthConn) AuthKey() []byte { return c.key }
+
+// Read reads through the handshake's buffer first, so nothing the peer sent along with its
+// last handshake line is lost.
+func (c *AuthConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// Handshake (SPAKE2, RFC 9382 over P-256); the password never crosses the wire:
+//
+//	dialer   -> HELLO P2P/2 <name> <pA hex>
+//	acceptor -> WELCOME P2P/2 <name> <pB hex> <confirmB hex>
+//	dialer   -> CONFIRM P2P/2 <confirmA hex>
+//
+// A wrong password shows up as a confirmation mismatch on whichever side checks first.
+// An acceptor at its connection limit answers HELLO with "BUSY P2P/2" and hangs up.
+
+// ErrBusy is returned by DialAndHandshake when the acceptor is already serving as many
+// peers as it allows.
+var ErrBusy = errors.New("peer is busy: too many concurrent connections")
+
+// Listener accepts password-authenticated peers on a TCP port until it is closed.
+type Listener struct {
+	ln       net.Listener
+	ourName  string
+	password string
+}
+
+// Listen opens a TCP listener on port that authenticates peers with password.
+func Listen(ourName string, port int, password string) (*Listener, error) {
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
-	defer ln.Close()
+	return &Listener{ln: ln, ourName: ourName, password: password}, nil
+}
+
+// Addr returns the listener's network address.
+func (l *Listener) Addr() net.Addr { return l.ln.Addr() }
+
+// Close stops accepting; connections already handed out stay open.
+func (l *Listener) Close() error { return l.ln.Close() }
+
+// Accept returns the next connection that completes a valid handshake. Failed handshakes
+// are logged (by acceptHandshake) and skipped.
+func (l *Listener) Accept() (net.Conn, string, error) {
 	for {
-		conn, err := ln.Accept()
+		conn, err := l.ln.Accept()
 		if err != nil {
 			return nil, "", err
 		}
-		// Perform handshake manually without closing conn
-		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
-		r := bufio.NewReader(conn)
-		line, _ := r.ReadString('\n')
-		line = strings.TrimSpace(line)
-		const prefix = "HELLO "
-		if !strings.HasPrefix(line, prefix) || len(line) <= len(prefix) {
-			conn.Close()
+		ac, peer, err := acceptHandshake(conn, l.ourName, l.password)
+		if err != nil {
 			continue
 		}
-		rest := strings.TrimSpace(line[len(prefix):])
-		if !strings.HasPrefix(rest, handshakeMagic+" ") || len(rest) <= len(handshakeMagic)+1 {
-			conn.Close()
-			continue
+		return ac, peer, nil
+	}
+}
+
+// Serve accepts peers until the listener is closed and calls handle for each authenticated
+// connection in its own goroutine. At most maxPeers connections (handshakes included) hold a
+// slot at once; further dialers are told the node is busy. handle may call release to give
+// the slot back early, for a connection that turns out not to count as a peer, such as an
+// extra connection of a parallel transfer. maxPeers <= 0 means no limit.
+// Serve closes each connection after handle returns.
+func (l *Listener) Serve(maxPeers int, handle func(conn net.Conn, peer string, release func())) error {
+	var slots chan struct{}
+	if maxPeers > 0 {
+		slots = make(chan struct{}, maxPeers)
+	}
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			return err
 		}
-		rest = strings.TrimSpace(rest[len(handshakeMagic)+1:])
-		parts := strings.Fields(rest)
-		if len(parts) < 2 {
-			conn.Close()
-			continue
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				log.Printf("Refused %s: %d peer(s) already connected", conn.RemoteAddr(), maxPeers)
+				go refuseBusy(conn)
+				continue
+			}
 		}
-		peerName := parts[0]
-		providedPassword := parts[1]
-		if providedPassword != expectedPassword {
-			_, _ = conn.Write([]byte("DENY " + handshakeMagic + "\n"))
-			conn.Close()
-			continue
+		go func() {
+			var once sync.Once
+			release := func() {
+				if slots != nil {
+					once.Do(func() { <-slots })
+				}
+			}
+			defer release()
+			ac, peer, err := acceptHandshake(conn, l.ourName, l.password)
+			if err != nil {
+				return
+			}
+			defer ac.Close()
+			handle(ac, peer, release)
+		}()
+	}
+}
+
+// refuseBusy reads the dialer's HELLO before answering BUSY, so the reply is not lost to a
+// reset caused by closing with unread data.
+func refuseBusy(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		return
+	}
+	_, _ = conn.Write([]byte("BUSY " + handshakeMagic + "\n"))
+}
+
+// ListenAndAcceptOnce listens on port and returns the first connection that completes
+// a valid password-authenticated handshake. The returned connection remains open for the caller.
+func ListenAndAcceptOnce(ourName string, port int, expectedPassword string) (net.Conn, string, error) {
+	l, err := Listen(ourName, port, expectedPassword)
+	if err != nil {
+		return nil, "", err
+	}
+	defer l.Close()
+	return l.Accept()
+}
+
+// acceptHandshake runs the acceptor side of the handshake on conn. On failure it logs why
+// and closes conn.
+func acceptHandshake(conn net.Conn, ourName, expectedPassword string) (*AuthConn, string, error) {
+	var peerName string
+	fail := func(err error) (*AuthConn, string, error) {
+		who := conn.RemoteAddr().String()
+		if peerName != "" {
+			who = fmt.Sprintf("%s (%s)", peerName, who)
 		}
-		// Success
-		_, _ = conn.Write([]byte("WELCOME " + handshakeMagic + " " + ourName + "\n"))
-		_ = conn.SetDeadline(time.Time{})
-		log.Printf("Local connection established with %s (%s)", peerName, conn.RemoteAddr())
-		return conn, peerName, nil
+		log.Printf("Handshake with %s failed: %v", who, err)
+		conn.Close()
+		return nil, "", err
+	}
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	fields, err := readHandshakeLine(r, "HELLO", 2)
+	if err != nil {
+		return fail(err)
 	}
+	peerName = fields[0]
+	pA, err := hex.DecodeString(fields[1])
+	if err != nil {
+		return fail(err)
+	}
+	pake, err := pcrypto.NewSPAKE2(pcrypto.PAKEServer, expectedPassword)
+	if err != nil {
+		return fail(err)
+	}
+	keys, err := pake.Finish(pA, peerName, ourName)
+	if err != nil {
+		return fail(err)
+	}
+	_, _ = conn.Write([]byte("WELCOME " + handshakeMagic + " " + ourName + " " +
+		hex.EncodeToString(pake.Message()) + " " + hex.EncodeToString(keys.Confirm) + "\n"))
+	fields, err = readHandshakeLine(r, "CONFIRM", 1)
+	if err != nil {
+		// The dialer hangs up here when its password does not match ours.
+		return fail(err)
+	}
+	if mac, err := hex.DecodeString(fields[0]); err != nil || !keys.VerifyPeer(mac) {
+		_, _ = conn.Write([]byte("DENY " + handshakeMagic + "\n"))
+		return fail(ErrAuthFailed)
+	}
+	// Success
+	_ = conn.SetDeadline(time.Time{})
+	log.Printf("Local connection established with %s (%s)", peerName, conn.RemoteAddr())
+	return &AuthConn{Conn: conn, r: r, key: keys.Key}, peerName, nil
 }
 
 // DialAndHandshake establishes a TCP connection and completes the handshake, returning the open connection.
@@ -74,31 +215,68 @@ func DialAndHandshake(ip string, port int, ourName string, password string, time
 	}
 	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
 
-	// Send HELLO with protocol magic and password
-	_, err = conn.Write([]byte("HELLO " + handshakeMagic + " " + ourName + " " + password + "\n"))
+	pake, err := pcrypto.NewSPAKE2(pcrypto.PAKEClient, password)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	// Send HELLO with protocol magic and our SPAKE2 message
+	_, err = conn.Write([]byte("HELLO " + handshakeMagic + " " + ourName + " " + hex.EncodeToString(pake.Message()) + "\n"))
 	if err != nil {
 		conn.Close()
 		return nil, "", err
 	}
 
 	r := bufio.NewReader(conn)
-	resp, err := r.ReadString('\n')
+	fields, err := readHandshakeLine(r, "WELCOME", 3)
 	if err != nil {
 		conn.Close()
 		return nil, "", err
 	}
-	resp = strings.TrimSpace(resp)
-	const prefix = "WELCOME "
-	if !strings.HasPrefix(resp, prefix) || len(resp) <= len(prefix) {
+	peer := fields[0]
+	pB, err := hex.DecodeString(fields[1])
+	if err != nil {
 		conn.Close()
 		return nil, "", fmt.Errorf("invalid handshake response")
 	}
-	rest := strings.TrimSpace(resp[len(prefix):])
-	if !strings.HasPrefix(rest, handshakeMagic+" ") || len(rest) <= len(handshakeMagic)+1 {
+	keys, err := pake.Finish(pB, ourName, peer)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	if mac, err := hex.DecodeString(fields[2]); err != nil || !keys.VerifyPeer(mac) {
 		conn.Close()
-		return nil, "", fmt.Errorf("invalid handshake magic")
+		return nil, "", ErrAuthFailed
+	}
+	if _, err := conn.Write([]byte("CONFIRM " + handshakeMagic + " " + hex.EncodeToString(keys.Confirm) + "\n")); err != nil {
+		conn.Close()
+		return nil, "", err
 	}
-	peer := strings.TrimSpace(rest[len(handshakeMagic)+1:])
 	_ = conn.SetDeadline(time.Time{})
-	return conn, peer, nil
+	return &AuthConn{Conn: conn, r: r, key: keys.Key}, peer, nil
+}
+
+// readHandshakeLine reads "<verb> P2P/2 <fields...>" and returns exactly n fields.
+func readHandshakeLine(r *bufio.Reader, verb string, n int) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Fields(line)
+	if len(parts) >= 1 && parts[0] == "DENY" {
+		return nil, ErrAuthFailed
+	}
+	if len(parts) >= 1 && parts[0] == "BUSY" {
+		return nil, ErrBusy
+	}
+	if len(parts) < 2 || parts[0] != verb {
+		return nil, fmt.Errorf("invalid handshake response")
+	}
+	if parts[1] != handshakeMagic {
+		return nil, fmt.Errorf("invalid handshake magic: %s (want %s)", parts[1], handshakeMagic)
+	}
+	if len(parts) != n+2 {
+		return nil, fmt.Errorf("invalid handshake response")
+	}
+	return parts[2:], nil
 }
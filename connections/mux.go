@@ -0,0 +1,444 @@
+package connections
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream multiplexing. A Mux turns one connection (an AuthConn or a WebRTC data channel)
+// into any number of independent streams, so transfers, chat and other control traffic
+// share the link without one holding up the rest:
+//
+//	frame  = type(1) | stream id(4, big-endian) | length(4, big-endian) | payload
+//	hello  (0x10): sent by both sides first; payload is the mux version (1 byte)
+//	open   (0x11): starts a stream; payload is its label, e.g. "transfer" or "chat". The
+//	               client (dialer or WebRTC offerer) numbers its streams odd, the server even
+//	data   (0x12): up to maxMuxPayload bytes of a stream
+//	close  (0x13): the sender of the frame is done with the stream in both directions
+//	window (0x14): payload uint32(n): the receiver consumed n more bytes of the stream
+//
+// Flow control is per stream: a sender may have at most muxWindow bytes of a stream in
+// flight that the receiving application has not read yet. A stream whose reader is slow
+// (a prompt, a busy disk) therefore stops only itself, and memory stays bounded.
+// The frames themselves are not encrypted; transfers seal what they send inside a stream.
+
+const (
+	frameHello  byte = 0x10
+	frameOpen   byte = 0x11
+	frameData   byte = 0x12
+	frameClose  byte = 0x13
+	frameWindow byte = 0x14
+)
+
+const (
+	muxVersion     = 2
+	muxHeaderLen   = 9
+	maxMuxPayload  = 64 << 10
+	maxMuxLabel    = 64
+	muxWindow      = 1 << 20 // per stream and direction
+	muxAcceptQueue = 16      // streams opened by the peer and not yet accepted
+)
+
+// ErrMuxClosed is returned once the mux or its connection has been closed.
+var ErrMuxClosed = errors.New("mux closed")
+
+// ErrMuxVersion is returned when the peer does not speak this version of the mux, e.g. an
+// older node that starts a transfer on the bare connection.
+var ErrMuxVersion = errors.New("peer does not speak this stream multiplexing version")
+
+// Mux carries independent streams over one connection (see above).
+type Mux struct {
+	conn net.Conn
+	br   *bufio.Reader
+	wmu  sync.Mutex // serializes frames on conn
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error // set once the connection failed or was closed
+	accept  chan *Stream
+	done    chan struct{}
+}
+
+// NewMux starts multiplexing conn. client tells the two ends apart: the side that dialed the
+// connection, or made the WebRTC offer, passes true. The mux owns conn from now on.
+func NewMux(conn net.Conn, client bool) *Mux {
+	m := &Mux{
+		conn:    conn,
+		br:      bufio.NewReader(conn),
+		streams: make(map[uint32]*Stream),
+		nextID:  2,
+		accept:  make(chan *Stream, muxAcceptQueue),
+		done:    make(chan struct{}),
+	}
+	if client {
+		m.nextID = 1
+	}
+	// The hello goes out first but must not block the caller on a peer that is not reading
+	// yet; holding the write lock until it is written keeps every other frame behind it.
+	// A failed write shows up in the read loop as well.
+	hello := muxFrame(frameHello, 0, []byte{muxVersion})
+	m.wmu.Lock()
+	go func() {
+		defer m.wmu.Unlock()
+		_, _ = conn.Write(hello)
+	}()
+	go m.readLoop()
+	return m
+}
+
+// SingleStream multiplexes conn and opens its only stream, for a connection that carries a
+// single exchange, such as an extra connection of a parallel transfer. Closing the stream
+// closes conn.
+func SingleStream(conn net.Conn, label string) (*Stream, error) {
+	m := NewMux(conn, true)
+	st, err := m.Open(label)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	st.closesMux = true
+	return st, nil
+}
+
+// Open starts a new stream to the peer; label tells the peer what it is for.
+func (m *Mux) Open(label string) (*Stream, error) {
+	if len(label) > maxMuxLabel {
+		return nil, fmt.Errorf("stream label longer than %d bytes", maxMuxLabel)
+	}
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	st := m.newStream(m.nextID, label)
+	m.nextID += 2
+	m.mu.Unlock()
+	if err := m.writeFrame(frameOpen, st.id, []byte(label)); err != nil {
+		m.fail(err)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the next stream the peer opens.
+func (m *Mux) Accept() (*Stream, error) {
+	select {
+	case st := <-m.accept:
+		return st, nil
+	case <-m.done:
+		// Streams that arrived before the end are still handed out
+		select {
+		case st := <-m.accept:
+			return st, nil
+		default:
+		}
+		return nil, m.Err()
+	}
+}
+
+// Close ends the mux and every stream on it.
+func (m *Mux) Close() error {
+	m.fail(ErrMuxClosed)
+	return m.conn.Close()
+}
+
+// Done is closed when the mux has ended.
+func (m *Mux) Done() <-chan struct{} { return m.done }
+
+// Err returns why the mux ended, or nil while it is open.
+func (m *Mux) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// newStream registers a stream; m.mu must be held.
+func (m *Mux) newStream(id uint32, label string) *Stream {
+	st := &Stream{m: m, id: id, label: label, sendWindow: muxWindow}
+	st.cond = sync.NewCond(&st.mu)
+	m.streams[id] = st
+	return st
+}
+
+// fail ends the mux with err (the first error wins) and wakes every stream.
+func (m *Mux) fail(err error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.err = err
+	streams := m.streams
+	m.streams = map[uint32]*Stream{}
+	close(m.done)
+	m.mu.Unlock()
+	for _, st := range streams {
+		st.mu.Lock()
+		st.cond.Broadcast()
+		st.mu.Unlock()
+	}
+	_ = m.conn.Close()
+}
+
+func (m *Mux) writeFrame(typ byte, id uint32, payload []byte) error {
+	b := muxFrame(typ, id, payload)
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	_, err := m.conn.Write(b)
+	return err
+}
+
+// muxFrame encodes one frame.
+func muxFrame(typ byte, id uint32, payload []byte) []byte {
+	b := make([]byte, muxHeaderLen+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:5], id)
+	binary.BigEndian.PutUint32(b[5:9], uint32(len(payload)))
+	copy(b[muxHeaderLen:], payload)
+	return b
+}
+
+// readLoop dispatches incoming frames until the connection fails.
+func (m *Mux) readLoop() {
+	m.fail(m.readFrames())
+}
+
+func (m *Mux) readFrames() error {
+	hdr := make([]byte, muxHeaderLen)
+	hello := false
+	for {
+		if _, err := io.ReadFull(m.br, hdr); err != nil {
+			return err
+		}
+		typ, id, n := hdr[0], binary.BigEndian.Uint32(hdr[1:5]), binary.BigEndian.Uint32(hdr[5:9])
+		if !hello && typ != frameHello {
+			return fmt.Errorf("%w: first message 0x%02x", ErrMuxVersion, typ)
+		}
+		if n > maxMuxPayload {
+			return fmt.Errorf("mux frame too large: %d", n)
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(m.br, payload); err != nil {
+			return err
+		}
+		switch typ {
+		case frameHello:
+			if hello || n != 1 || payload[0] != muxVersion {
+				return fmt.Errorf("%w: peer hello %x, want version %d", ErrMuxVersion, payload, muxVersion)
+			}
+			hello = true
+		case frameOpen:
+			if err := m.remoteOpen(id, payload); err != nil {
+				return err
+			}
+		case frameData:
+			if st := m.stream(id); st != nil {
+				if err := st.push(payload); err != nil {
+					return err
+				}
+			}
+		case frameClose:
+			m.mu.Lock()
+			st := m.streams[id]
+			delete(m.streams, id)
+			m.mu.Unlock()
+			if st != nil {
+				st.remoteClose()
+			}
+		case frameWindow:
+			if n != 4 {
+				return fmt.Errorf("invalid window update for stream %d", id)
+			}
+			if st := m.stream(id); st != nil {
+				st.grow(binary.BigEndian.Uint32(payload))
+			}
+		default:
+			return fmt.Errorf("unexpected mux frame type: 0x%02x", typ)
+		}
+	}
+}
+
+// remoteOpen registers a stream the peer opened and queues it for Accept. When the queue is
+// full the stream is closed right away.
+func (m *Mux) remoteOpen(id uint32, label []byte) error {
+	m.mu.Lock()
+	if id%2 == m.nextID%2 || m.streams[id] != nil || len(label) > maxMuxLabel {
+		m.mu.Unlock()
+		return fmt.Errorf("peer opened invalid stream %d", id)
+	}
+	st := m.newStream(id, string(label))
+	m.mu.Unlock()
+	select {
+	case m.accept <- st:
+		return nil
+	default:
+		return st.Close()
+	}
+}
+
+func (m *Mux) stream(id uint32) *Stream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams[id]
+}
+
+// Stream is one stream of a Mux. It implements net.Conn; deadlines are accepted but not
+// enforced. On an authenticated connection it also passes on AuthKey, so transfers on the
+// stream stay bound to the password-authenticated handshake.
+type Stream struct {
+	m     *Mux
+	id    uint32
+	label string
+	// closesMux makes Close end the whole mux (see SingleStream).
+	closesMux bool
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	buf          bytes.Buffer // received and not yet read
+	unacked      int          // bytes read since the last window update we sent
+	sendWindow   int          // bytes we may still send before the peer grants more
+	remoteClosed bool
+	closed       bool
+}
+
+// Label returns what the stream was opened for.
+func (st *Stream) Label() string { return st.label }
+
+// push queues received data; more than the window allows is a protocol violation.
+func (st *Stream) push(p []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return nil
+	}
+	if st.buf.Len()+st.unacked+len(p) > muxWindow {
+		return fmt.Errorf("peer overran the window of stream %d", st.id)
+	}
+	st.buf.Write(p)
+	st.cond.Broadcast()
+	return nil
+}
+
+func (st *Stream) grow(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += int(n)
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	for st.buf.Len() == 0 {
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		case st.remoteClosed:
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		if err := st.m.Err(); err != nil {
+			st.mu.Unlock()
+			return 0, err
+		}
+		st.cond.Wait()
+	}
+	n, _ := st.buf.Read(p)
+	// Grant the peer more once half the window has been consumed
+	st.unacked += n
+	var grant uint32
+	if st.unacked >= muxWindow/2 && !st.remoteClosed {
+		grant, st.unacked = uint32(st.unacked), 0
+	}
+	st.mu.Unlock()
+	if grant > 0 {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], grant)
+		if err := st.m.writeFrame(frameWindow, st.id, b[:]); err != nil {
+			st.m.fail(err)
+		}
+	}
+	return n, nil
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		for st.sendWindow == 0 && !st.closed && !st.remoteClosed && st.m.Err() == nil {
+			st.cond.Wait()
+		}
+		if st.closed || st.remoteClosed {
+			st.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if err := st.m.Err(); err != nil {
+			st.mu.Unlock()
+			return written, err
+		}
+		n := min(len(p), maxMuxPayload, st.sendWindow)
+		st.sendWindow -= n
+		st.mu.Unlock()
+		if err := st.m.writeFrame(frameData, st.id, p[:n]); err != nil {
+			st.m.fail(err)
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close ends the stream in both directions; data the peer still sends is dropped.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	remoteClosed := st.remoteClosed
+	st.buf.Reset()
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	if st.closesMux {
+		return st.m.Close()
+	}
+	st.m.mu.Lock()
+	delete(st.m.streams, st.id)
+	alive := st.m.err == nil
+	st.m.mu.Unlock()
+	if remoteClosed || !alive {
+		return nil
+	}
+	return st.m.writeFrame(frameClose, st.id, nil)
+}
+
+// AuthKey returns the key of the password-authenticated connection below, if any.
+func (st *Stream) AuthKey() []byte {
+	if ak, ok := st.m.conn.(interface{ AuthKey() []byte }); ok {
+		return ak.AuthKey()
+	}
+	return nil
+}
+
+func (st *Stream) LocalAddr() net.Addr                { return st.m.conn.LocalAddr() }
+func (st *Stream) RemoteAddr() net.Addr               { return st.m.conn.RemoteAddr() }
+func (st *Stream) SetDeadline(t time.Time) error      { return nil }
+func (st *Stream) SetReadDeadline(t time.Time) error  { return nil }
+func (st *Stream) SetWriteDeadline(t time.Time) error { return nil }
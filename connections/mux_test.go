@@ -0,0 +1,245 @@
+package connections
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// muxPair returns the two ends of a multiplexed in-memory connection.
+func muxPair(t *testing.T) (client, server *Mux) {
+	t.Helper()
+	a, b := net.Pipe()
+	client, server = NewMux(a, true), NewMux(b, false)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// openPair opens a stream on client and accepts it on server.
+func openPair(t *testing.T, client, server *Mux, label string) (*Stream, *Stream) {
+	t.Helper()
+	st, err := client.Open(label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Label() != label {
+		t.Fatalf("accepted stream %q, want %q", peer.Label(), label)
+	}
+	return st, peer
+}
+
+// within fails the test unless ch delivers within d.
+func within[T any](t *testing.T, ch <-chan T, d time.Duration, what string) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(d):
+		t.Fatalf("%s: timed out", what)
+		panic("unreachable")
+	}
+}
+
+func TestMuxWriterWaitsForWindow(t *testing.T) {
+	client, server := muxPair(t)
+	st, peer := openPair(t, client, server, "transfer")
+
+	data := make([]byte, 3*muxWindow+12345)
+	rand.Read(data)
+	written := make(chan error, 1)
+	go func() {
+		_, err := st.Write(data)
+		written <- err
+	}()
+
+	// Nobody reads yet: the writer stops once a window is in flight, and the receiver
+	// holds no more than that
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case err := <-written:
+		t.Fatalf("write of %d bytes finished without a reader: %v", len(data), err)
+	default:
+	}
+	peer.mu.Lock()
+	buffered := peer.buf.Len()
+	peer.mu.Unlock()
+	if buffered == 0 || buffered > muxWindow {
+		t.Fatalf("receiver buffered %d bytes, want 1..%d", buffered, muxWindow)
+	}
+
+	// Reading grants more window, so the writer resumes and finishes
+	got := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, len(data))
+		_, err := io.ReadFull(peer, b)
+		if err != nil {
+			t.Error(err)
+		}
+		got <- b
+	}()
+	if err := within(t, written, 10*time.Second, "write"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(within(t, got, 10*time.Second, "read"), data) {
+		t.Fatal("data mismatch")
+	}
+}
+
+func TestMuxStalledStreamDoesNotBlockOthers(t *testing.T) {
+	client, server := muxPair(t)
+	stalled, _ := openPair(t, client, server, "transfer")
+	go stalled.Write(make([]byte, 2*muxWindow)) // never read
+
+	chat, peer := openPair(t, client, server, "chat")
+	done := make(chan string, 1)
+	go func() {
+		b, _ := io.ReadAll(peer)
+		done <- string(b)
+	}()
+	time.Sleep(100 * time.Millisecond) // let the stalled stream fill its window
+	if _, err := io.WriteString(chat, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	chat.Close()
+	if msg := within(t, done, 5*time.Second, "chat"); msg != "hello" {
+		t.Fatalf("chat got %q", msg)
+	}
+}
+
+// rawFrame encodes one mux frame for a hand-written peer.
+func rawFrame(typ byte, id uint32, payload []byte) []byte {
+	b := make([]byte, muxHeaderLen, muxHeaderLen+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:5], id)
+	binary.BigEndian.PutUint32(b[5:9], uint32(len(payload)))
+	return append(b, payload...)
+}
+
+func TestMuxRejectsWindowOverrun(t *testing.T) {
+	a, b := net.Pipe()
+	m := NewMux(a, false)
+	defer m.Close()
+	go io.Copy(io.Discard, b)
+	go func() {
+		b.Write(rawFrame(frameHello, 0, []byte{muxVersion}))
+		b.Write(rawFrame(frameOpen, 1, []byte("transfer")))
+		// Nothing is read on our side, so no window update comes: one byte more than the
+		// window is a violation
+		chunk := make([]byte, maxMuxPayload)
+		for sent := 0; sent <= muxWindow; sent += len(chunk) {
+			if _, err := b.Write(rawFrame(frameData, 1, chunk)); err != nil {
+				return
+			}
+		}
+		b.Write(rawFrame(frameData, 1, []byte{0}))
+	}()
+	within(t, m.Done(), 5*time.Second, "mux end")
+	if err := m.Err(); err == nil || !strings.Contains(err.Error(), "overran the window") {
+		t.Fatalf("mux ended with %v, want a window overrun", err)
+	}
+}
+
+func TestMuxRejectsOtherVersion(t *testing.T) {
+	a, b := net.Pipe()
+	m := NewMux(a, false)
+	defer m.Close()
+	go io.Copy(io.Discard, b)
+	go b.Write(rawFrame(frameHello, 0, []byte{muxVersion + 1}))
+	within(t, m.Done(), 5*time.Second, "mux end")
+	if !errors.Is(m.Err(), ErrMuxVersion) {
+		t.Fatalf("mux ended with %v, want ErrMuxVersion", m.Err())
+	}
+}
+
+func TestMuxCloseStreamLeavesOthersOpen(t *testing.T) {
+	client, server := muxPair(t)
+	s1, p1 := openPair(t, client, server, "transfer")
+	s2, p2 := openPair(t, client, server, "transfer")
+
+	// Data written before Close is still delivered, then the peer sees EOF
+	if _, err := io.WriteString(s1, "last words"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(p1)
+	if err != nil || string(b) != "last words" {
+		t.Fatalf("read %q, %v", b, err)
+	}
+	if _, err := p1.Write([]byte("x")); err == nil {
+		t.Fatal("write to a stream the peer closed succeeded")
+	}
+	if _, err := s1.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read from a closed stream succeeded")
+	}
+
+	// The other stream still works both ways
+	for _, pair := range [][2]*Stream{{s2, p2}, {p2, s2}} {
+		if _, err := io.WriteString(pair[0], "ping"); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(pair[1], buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("read %q, %v", buf, err)
+		}
+	}
+}
+
+func TestMuxCloseEndsOpenStreams(t *testing.T) {
+	client, server := muxPair(t)
+	st, peer := openPair(t, client, server, "transfer")
+
+	// A reader, a writer stuck on a full window and an Accept, all waiting on the peer
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := peer.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := st.Write(make([]byte, 2*muxWindow))
+		writeErr <- err
+	}()
+	acceptErr := make(chan error, 1)
+	go func() {
+		_, err := server.Accept()
+		acceptErr <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	client.Close()
+	if err := within(t, writeErr, 5*time.Second, "write"); err == nil {
+		t.Fatal("write finished on a closed mux")
+	}
+	if _, err := client.Open("transfer"); !errors.Is(err, ErrMuxClosed) {
+		t.Fatalf("Open after Close: %v, want ErrMuxClosed", err)
+	}
+	// The peer's reader gets what arrived, then an error; it never hangs
+	for {
+		err := within(t, readErr, 5*time.Second, "peer read")
+		if err != nil {
+			break
+		}
+		go func() {
+			_, err := peer.Read(make([]byte, muxWindow))
+			readErr <- err
+		}()
+	}
+	if err := within(t, acceptErr, 5*time.Second, "accept"); err == nil {
+		t.Fatal("Accept returned a stream after the connection ended")
+	}
+}
@@ -0,0 +1,361 @@
+package connections
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"golang.org/x/net/websocket"
+)
+
+// SignalMessage is relayed between the two peers of a signaling room.
+type SignalMessage struct {
+	Type      string `json:"type"`                // "ready", "offer", "answer", "candidate", "peer-left", "error"
+	SDP       string `json:"sdp,omitempty"`       // base64 session description, as printed in copy-paste mode
+	Candidate string `json:"candidate,omitempty"` // JSON ICECandidateInit for trickle ICE
+	Error     string `json:"error,omitempty"`
+}
+
+// roomCapacity is the number of peers a room pairs up.
+const roomCapacity = 2
+
+// SignalingServer relays SDP and ICE messages between peers that join the same named room
+// over WebSocket (GET /ws?room=<name>). It keeps no state beyond the open sockets.
+type SignalingServer struct {
+	mu    sync.Mutex
+	rooms map[string][]*signalPeer
+}
+
+type signalPeer struct {
+	ws *websocket.Conn
+	mu sync.Mutex // serialises writes
+}
+
+func (p *signalPeer) send(m SignalMessage) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return websocket.JSON.Send(p.ws, m)
+}
+
+// NewSignalingServer returns an empty signaling server.
+func NewSignalingServer() *SignalingServer {
+	return &SignalingServer{rooms: make(map[string][]*signalPeer)}
+}
+
+// Handler returns the HTTP handler serving the /ws endpoint.
+func (s *SignalingServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(s.serveWS))
+	return mux
+}
+
+// ListenAndServeSignaling runs a signaling server on addr until it fails.
+func ListenAndServeSignaling(addr string) error {
+	log.Printf("Signaling server listening on %s (ws://<host>%s/ws?room=<name>)", addr, addr)
+	return http.ListenAndServe(addr, NewSignalingServer().Handler())
+}
+
+func (s *SignalingServer) serveWS(ws *websocket.Conn) {
+	defer ws.Close()
+	room := ws.Request().URL.Query().Get("room")
+	self := &signalPeer{ws: ws}
+	if room == "" {
+		_ = self.send(SignalMessage{Type: "error", Error: "missing room"})
+		return
+	}
+
+	s.mu.Lock()
+	if len(s.rooms[room]) >= roomCapacity {
+		s.mu.Unlock()
+		_ = self.send(SignalMessage{Type: "error", Error: "room full"})
+		return
+	}
+	s.rooms[room] = append(s.rooms[room], self)
+	members := append([]*signalPeer(nil), s.rooms[room]...)
+	s.mu.Unlock()
+	log.Printf("Signaling: peer joined room %q (%d/%d)", room, len(members), roomCapacity)
+
+	if len(members) == roomCapacity {
+		for _, p := range members {
+			_ = p.send(SignalMessage{Type: "ready"})
+		}
+	}
+	defer s.leave(room, self)
+
+	for {
+		var m SignalMessage
+		if err := websocket.JSON.Receive(ws, &m); err != nil {
+			return
+		}
+		for _, p := range s.others(room, self) {
+			_ = p.send(m)
+		}
+	}
+}
+
+func (s *SignalingServer) others(room string, self *signalPeer) []*signalPeer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*signalPeer
+	for _, p := range s.rooms[room] {
+		if p != self {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func (s *SignalingServer) leave(room string, self *signalPeer) {
+	s.mu.Lock()
+	members := s.rooms[room]
+	for i, p := range members {
+		if p == self {
+			members = append(members[:i], members[i+1:]...)
+			break
+		}
+	}
+	if len(members) == 0 {
+		delete(s.rooms, room)
+	} else {
+		s.rooms[room] = members
+	}
+	s.mu.Unlock()
+	for _, p := range members {
+		_ = p.send(SignalMessage{Type: "peer-left"})
+	}
+	log.Printf("Signaling: peer left room %q", room)
+}
+
+// SignalClient is one peer's connection to a signaling room.
+type SignalClient struct {
+	ws *websocket.Conn
+	mu sync.Mutex
+}
+
+// JoinRoom connects to the signaling server at serverURL (e.g. ws://192.168.1.10:8080)
+// and joins room.
+func JoinRoom(serverURL, room string) (*SignalClient, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("signaling url: %w", err)
+	}
+	switch u.Scheme {
+	case "ws", "wss":
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return nil, fmt.Errorf("signaling url: unsupported scheme %q", u.Scheme)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/ws"
+	u.RawQuery = url.Values{"room": {room}}.Encode()
+	origin := "http://" + u.Host
+	ws, err := websocket.Dial(u.String(), "", origin)
+	if err != nil {
+		return nil, fmt.Errorf("join room: %w", err)
+	}
+	return &SignalClient{ws: ws}, nil
+}
+
+// Send relays m to the other peer in the room.
+func (c *SignalClient) Send(m SignalMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return websocket.JSON.Send(c.ws, m)
+}
+
+// Recv blocks for the next message from the room. Server-side errors are returned as errors.
+func (c *SignalClient) Recv() (SignalMessage, error) {
+	var m SignalMessage
+	if err := websocket.JSON.Receive(c.ws, &m); err != nil {
+		return SignalMessage{}, err
+	}
+	if m.Type == "error" {
+		return SignalMessage{}, fmt.Errorf("signaling: %s", m.Error)
+	}
+	return m, nil
+}
+
+// Close leaves the room.
+func (c *SignalClient) Close() error { return c.ws.Close() }
+
+// OfferViaSignaling runs the offerer side over a room: wait for the other peer, send the
+// offer and apply the answer. With trickle, the offer is sent before ICE gathering finishes
+// and candidates follow as "candidate" messages in both directions; otherwise the offer
+// carries every candidate, as in copy-paste mode.
+// It takes ownership of sc and closes it once candidates are no longer needed.
+func OfferViaSignaling(sc *SignalClient, ice ICEConfig, trickle bool) (*Peer, error) {
+	if err := waitSignal(sc, "ready"); err != nil {
+		sc.Close()
+		return nil, err
+	}
+	w, peer, err := newOfferer(ice)
+	if err != nil {
+		sc.Close()
+		return nil, err
+	}
+	if trickle {
+		sendCandidates(w, sc)
+	}
+	offerB64, err := createOffer(w, !trickle)
+	if err == nil {
+		err = sc.Send(SignalMessage{Type: "offer", SDP: offerB64})
+	}
+	if err != nil {
+		sc.Close()
+		w.Close()
+		return nil, fmt.Errorf("send offer: %w", err)
+	}
+
+	var pending []string
+	for {
+		m, err := sc.Recv()
+		if err != nil {
+			sc.Close()
+			w.Close()
+			return nil, err
+		}
+		switch m.Type {
+		case "answer":
+			if err := AcceptAnswer(peer, m.SDP); err != nil {
+				sc.Close()
+				w.Close()
+				return nil, err
+			}
+			finishTrickle(sc, peer, pending, trickle)
+			return peer, nil
+		case "candidate":
+			// Candidates can overtake the answer; hold them until the remote description is set.
+			pending = append(pending, m.Candidate)
+		case "peer-left":
+			sc.Close()
+			w.Close()
+			return nil, errPeerLeft
+		}
+	}
+}
+
+// AnswerViaSignaling waits for an offer in the room, answers it and returns the peer.
+// With trickle, the answer is sent right away and candidates follow separately.
+// It takes ownership of sc and closes it once candidates are no longer needed.
+func AnswerViaSignaling(sc *SignalClient, ice ICEConfig, trickle bool) (*Peer, error) {
+	w, peer, err := newAnswerer(ice)
+	if err != nil {
+		sc.Close()
+		return nil, err
+	}
+	if trickle {
+		sendCandidates(w, sc)
+	}
+	var pending []string
+	for {
+		m, err := sc.Recv()
+		if err != nil {
+			sc.Close()
+			w.Close()
+			return nil, err
+		}
+		switch m.Type {
+		case "offer":
+			ansB64, err := answerOffer(w, m.SDP, !trickle)
+			if err == nil {
+				err = sc.Send(SignalMessage{Type: "answer", SDP: ansB64})
+			}
+			if err != nil {
+				sc.Close()
+				w.Close()
+				return nil, fmt.Errorf("send answer: %w", err)
+			}
+			finishTrickle(sc, peer, pending, trickle)
+			return peer, nil
+		case "candidate":
+			pending = append(pending, m.Candidate)
+		case "peer-left":
+			sc.Close()
+			w.Close()
+			return nil, errPeerLeft
+		}
+	}
+}
+
+// sendCandidates forwards each locally gathered ICE candidate to the room as it appears.
+func sendCandidates(w *WebRTC, sc *SignalClient) {
+	w.PeerConn.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil { // gathering complete
+			return
+		}
+		b, err := json.Marshal(c.ToJSON())
+		if err != nil {
+			return
+		}
+		_ = sc.Send(SignalMessage{Type: "candidate", Candidate: string(b)})
+	})
+}
+
+// finishTrickle applies candidates that arrived before the remote description and keeps
+// adding new ones in the background until the peer connects, then closes sc.
+// Without trickle there is nothing more to exchange and sc is closed at once.
+func finishTrickle(sc *SignalClient, p *Peer, pending []string, trickle bool) {
+	if !trickle {
+		sc.Close()
+		return
+	}
+	for _, c := range pending {
+		addCandidate(p, c)
+	}
+	go func() {
+		select {
+		case <-p.Connected():
+		case <-time.After(trickleTimeout):
+		}
+		sc.Close()
+	}()
+	go func() {
+		for {
+			m, err := sc.Recv()
+			if err != nil {
+				return
+			}
+			if m.Type == "candidate" {
+				addCandidate(p, m.Candidate)
+			}
+		}
+	}()
+}
+
+// trickleTimeout bounds how long the signaling socket stays open for late candidates.
+const trickleTimeout = 30 * time.Second
+
+func addCandidate(p *Peer, raw string) {
+	var c webrtc.ICECandidateInit
+	if err := json.Unmarshal([]byte(raw), &c); err != nil {
+		log.Printf("Signaling: bad candidate: %v", err)
+		return
+	}
+	if err := p.pc.AddICECandidate(c); err != nil {
+		log.Printf("Signaling: add candidate: %v", err)
+	}
+}
+
+var errPeerLeft = errors.New("signaling: peer left the room")
+
+// waitSignal skips messages until one of the given type arrives.
+func waitSignal(sc *SignalClient, typ string) error {
+	for {
+		m, err := sc.Recv()
+		if err != nil {
+			return err
+		}
+		if m.Type == typ {
+			return nil
+		}
+	}
+}
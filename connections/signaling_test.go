@@ -0,0 +1,131 @@
+package connections
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signalingServer starts a signaling server on a local port and returns its ws:// URL.
+func signalingServer(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(NewSignalingServer().Handler())
+	t.Cleanup(srv.Close)
+	return strings.Replace(srv.URL, "http://", "ws://", 1)
+}
+
+// connectViaRoom pairs two nodes through room on the signaling server at url, the way two
+// `--signal` nodes on one machine do, and waits until both data channels are open.
+func connectViaRoom(t *testing.T, url, room string, trickle bool) (offerer, answerer *Peer) {
+	t.Helper()
+	ice := ICEConfig{LANOnly: true} // no external STUN server
+	type result struct {
+		p   *Peer
+		err error
+	}
+	answered := make(chan result, 1)
+	go func() {
+		sc, err := JoinRoom(url, room)
+		if err != nil {
+			answered <- result{nil, err}
+			return
+		}
+		p, err := AnswerViaSignaling(sc, ice, trickle)
+		answered <- result{p, err}
+	}()
+	sc, err := JoinRoom(url, room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offerer, err = OfferViaSignaling(sc, ice, trickle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { offerer.pc.Close() })
+	r := within(t, answered, 20*time.Second, "answer")
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	answerer = r.p
+	t.Cleanup(func() { answerer.pc.Close() })
+	within(t, offerer.Connected(), 20*time.Second, "offerer connection")
+	within(t, answerer.DataChannelReady(), 20*time.Second, "answerer data channel")
+	return offerer, answerer
+}
+
+func TestSignalingTwoNodes(t *testing.T) {
+	url := signalingServer(t)
+	for _, trickle := range []bool{false, true} {
+		name := "full-sdp"
+		if trickle {
+			name = "trickle"
+		}
+		t.Run(name, func(t *testing.T) {
+			offerer, answerer := connectViaRoom(t, url, "room-"+name, trickle)
+			a, err := offerer.DataChannelConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := answerer.DataChannelConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The primary channel carries data both ways
+			for _, pair := range [][2]io.ReadWriter{{a, b}, {b, a}} {
+				if _, err := io.WriteString(pair[0], "hello"); err != nil {
+					t.Fatal(err)
+				}
+				buf := make([]byte, 5)
+				if _, err := io.ReadFull(pair[1], buf); err != nil || string(buf) != "hello" {
+					t.Fatalf("read %q, %v", buf, err)
+				}
+			}
+			// Extra streams open on the same peer connection
+			x, err := offerer.OpenStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			y, err := answerer.AcceptStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(x, "extra"); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(y, buf); err != nil || string(buf) != "extra" {
+				t.Fatalf("read %q, %v", buf, err)
+			}
+			x.Close()
+			y.Close()
+		})
+	}
+}
+
+func TestSignalingRoomFull(t *testing.T) {
+	url := signalingServer(t)
+	var members []*SignalClient
+	for range roomCapacity {
+		sc, err := JoinRoom(url, "busy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sc.Close()
+		members = append(members, sc)
+	}
+	for _, sc := range members {
+		if m, err := sc.Recv(); err != nil || m.Type != "ready" {
+			t.Fatalf("got %+v, %v; want ready", m, err)
+		}
+	}
+	sc, err := JoinRoom(url, "busy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	if _, err := sc.Recv(); err == nil || !strings.Contains(err.Error(), "room full") {
+		t.Fatalf("third peer: %v, want room full", err)
+	}
+}
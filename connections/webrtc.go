@@ -4,11 +4,17 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/pion/webrtc/v4"
 )
 
+// primaryLabel names the data channel negotiated with the offer; channels opened later by
+// OpenStream carry other labels.
+const primaryLabel = "p2p"
+
 // WebRTC wraps Pion constructs needed to create an offer/answer and a data channel.
 type WebRTC struct {
 	API      *webrtc.API
@@ -21,10 +27,16 @@ type Peer struct {
 	connected chan struct{}
 	dc        *webrtc.DataChannel
 	dcReady   chan struct{}
+
+	// extra data channels for parallel transfers (see OpenStream / AcceptStream)
+	streamMu sync.Mutex
+	nstreams int
+	streams  chan *dcConn
 }
 
 // NewWebRTC creates a minimal WebRTC peer connection with a single ordered, reliable data channel.
-func NewWebRTC() (*WebRTC, error) {
+// ICE servers and policy come from ice; see ICEConfig.
+func NewWebRTC(ice ICEConfig) (*WebRTC, error) {
 	m := webrtc.MediaEngine{}
 	// No media for now; data-channel only.
 	if err := m.RegisterDefaultCodecs(); err != nil {
@@ -34,31 +46,9 @@ func NewWebRTC() (*WebRTC, error) {
 	s := webrtc.SettingEngine{}
 	api := webrtc.NewAPI(webrtc.WithMediaEngine(&m), webrtc.WithSettingEngine(s))
 
-	cfg := webrtc.Configuration{
-		ICETransportPolicy: webrtc.ICETransportPolicyAll,
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{
-				"stun:stun.l.google.com:19302",
-				"stun:stun1.l.google.com:19302",
-				"stun:stun2.l.google.com:19302",
-				"stun:stun3.l.google.com:19302",
-				"stun:stun4.l.google.com:19302",
-				"stun:stun.cloudflare.com:3478",
-				"stun:stun.stunprotocol.org:3478",
-				"stun:stun.relay.metered.ca:80",
-			}},
-			// Public TURN fallback (may relay; not pure P2P). Demo credentials only.
-			{
-				URLs: []string{
-					"turn:global.relay.metered.ca:80",
-					"turn:global.relay.metered.ca:443",
-					"turn:global.relay.metered.ca:80?transport=tcp",
-					"turns:global.relay.metered.ca:443?transport=tcp",
-				},
-				Username:   "c383bd85b91051c9a1253209",
-				Credential: "oybe0OgcmaWwDSWO",
-			},
-		},
+	cfg, err := ice.configuration()
+	if err != nil {
+		return nil, err
 	}
 
 	pc, err := api.NewPeerConnection(cfg)
@@ -94,22 +84,37 @@ func (w *WebRTC) SetRemoteAnswer(sdp string) error {
 func (w *WebRTC) Close() error { return w.PeerConn.Close() }
 
 // GenerateOffer creates an offerer peer, returns base64-encoded SDP offer and a peer handle.
-func GenerateOffer() (string, *Peer, error) {
-	w, err := NewWebRTC()
+// The offer is returned once ICE gathering completes, so it carries every candidate.
+func GenerateOffer(ice ICEConfig) (string, *Peer, error) {
+	w, peer, err := newOfferer(ice)
 	if err != nil {
 		return "", nil, err
 	}
+	enc, err := createOffer(w, true)
+	if err != nil {
+		w.Close()
+		return "", nil, err
+	}
+	return enc, peer, nil
+}
+
+// newOfferer creates the offerer's peer connection and data channel.
+func newOfferer(ice ICEConfig) (*WebRTC, *Peer, error) {
+	w, err := NewWebRTC(ice)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Create data channel on offerer side so negotiation includes it
-	dc, err := w.PeerConn.CreateDataChannel("p2p", nil)
+	dc, err := w.PeerConn.CreateDataChannel(primaryLabel, nil)
 	if err != nil {
 		w.Close()
-		return "", nil, fmt.Errorf("create data channel: %w", err)
+		return nil, nil, fmt.Errorf("create data channel: %w", err)
 	}
 
 	connected := make(chan struct{})
 	dcReady := make(chan struct{})
-	peer := &Peer{pc: w.PeerConn, connected: connected, dc: dc, dcReady: dcReady}
+	peer := &Peer{pc: w.PeerConn, connected: connected, dc: dc, dcReady: dcReady, streams: make(chan *dcConn, 8)}
 
 	dc.OnOpen(func() {
 		select {
@@ -132,24 +137,24 @@ func GenerateOffer() (string, *Peer, error) {
 			}
 		}
 	})
+	return w, peer, nil
+}
 
+// createOffer sets the local offer and returns it base64-encoded. With waitGather it blocks
+// until ICE gathering completes; otherwise candidates are left to trickle separately.
+func createOffer(w *WebRTC, waitGather bool) (string, error) {
 	offer, err := w.PeerConn.CreateOffer(nil)
 	if err != nil {
-		w.Close()
-		return "", nil, fmt.Errorf("create offer: %w", err)
+		return "", fmt.Errorf("create offer: %w", err)
 	}
+	gathered := webrtc.GatheringCompletePromise(w.PeerConn)
 	if err = w.PeerConn.SetLocalDescription(offer); err != nil {
-		w.Close()
-		return "", nil, fmt.Errorf("set local: %w", err)
+		return "", fmt.Errorf("set local: %w", err)
 	}
-	<-webrtc.GatheringCompletePromise(w.PeerConn)
-
-	enc, err := encodeSDP(*w.PeerConn.LocalDescription())
-	if err != nil {
-		w.Close()
-		return "", nil, err
+	if waitGather {
+		<-gathered
 	}
-	return enc, peer, nil
+	return encodeSDP(*w.PeerConn.LocalDescription())
 }
 
 // AcceptAnswer applies a base64-encoded SDP answer to the given offerer peer.
@@ -162,16 +167,35 @@ func AcceptAnswer(p *Peer, b64Ans string) error {
 }
 
 // AcceptOfferAndGenerateAnswer creates an answerer peer, applies the remote offer and returns a base64 answer.
-func AcceptOfferAndGenerateAnswer(b64Offer string) (string, *Peer, error) {
-	w, err := NewWebRTC()
+// The answer is returned once ICE gathering completes, so it carries every candidate.
+func AcceptOfferAndGenerateAnswer(b64Offer string, ice ICEConfig) (string, *Peer, error) {
+	w, peer, err := newAnswerer(ice)
+	if err != nil {
+		return "", nil, err
+	}
+	enc, err := answerOffer(w, b64Offer, true)
 	if err != nil {
+		w.Close()
 		return "", nil, err
 	}
+	return enc, peer, nil
+}
+
+// newAnswerer creates the answerer's peer connection; the data channel arrives from the offerer.
+func newAnswerer(ice ICEConfig) (*WebRTC, *Peer, error) {
+	w, err := NewWebRTC(ice)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	connected := make(chan struct{})
-	peer := &Peer{pc: w.PeerConn, connected: connected, dcReady: make(chan struct{})}
+	peer := &Peer{pc: w.PeerConn, connected: connected, dcReady: make(chan struct{}), streams: make(chan *dcConn, 8)}
 
 	w.PeerConn.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if dc.Label() != primaryLabel {
+			peer.queueStream(dc)
+			return
+		}
 		peer.dc = dc
 		dc.OnOpen(func() {
 			select {
@@ -195,38 +219,56 @@ func AcceptOfferAndGenerateAnswer(b64Offer string) (string, *Peer, error) {
 			}
 		}
 	})
+	return w, peer, nil
+}
 
+// answerOffer applies the remote offer, sets the local answer and returns it base64-encoded.
+// With waitGather it blocks until ICE gathering completes.
+func answerOffer(w *WebRTC, b64Offer string, waitGather bool) (string, error) {
 	var remote webrtc.SessionDescription
 	if err := decodeSDP(b64Offer, &remote); err != nil {
-		w.Close()
-		return "", nil, err
+		return "", err
 	}
 	if err := w.PeerConn.SetRemoteDescription(remote); err != nil {
-		w.Close()
-		return "", nil, fmt.Errorf("set remote: %w", err)
+		return "", fmt.Errorf("set remote: %w", err)
 	}
 	ans, err := w.PeerConn.CreateAnswer(nil)
 	if err != nil {
-		w.Close()
-		return "", nil, fmt.Errorf("create answer: %w", err)
+		return "", fmt.Errorf("create answer: %w", err)
 	}
+	gathered := webrtc.GatheringCompletePromise(w.PeerConn)
 	if err := w.PeerConn.SetLocalDescription(ans); err != nil {
-		w.Close()
-		return "", nil, fmt.Errorf("set local: %w", err)
+		return "", fmt.Errorf("set local: %w", err)
 	}
-	<-webrtc.GatheringCompletePromise(w.PeerConn)
-
-	enc, err := encodeSDP(*w.PeerConn.LocalDescription())
-	if err != nil {
-		w.Close()
-		return "", nil, err
+	if waitGather {
+		<-gathered
 	}
-	return enc, peer, nil
+	return encodeSDP(*w.PeerConn.LocalDescription())
 }
 
 // Connected returns a channel that closes when the peer is connected.
 func (p *Peer) Connected() <-chan struct{} { return p.connected }
 
+// ChannelBinding returns the DTLS certificate fingerprints announced in the local and remote
+// SDP, sorted and newline-joined so both peers compute the same bytes. It ties a short
+// authentication string to this particular DTLS connection.
+func (p *Peer) ChannelBinding() []byte {
+	var fps []string
+	for _, sd := range []*webrtc.SessionDescription{p.pc.LocalDescription(), p.pc.RemoteDescription()} {
+		if sd == nil {
+			continue
+		}
+		for _, line := range strings.Split(sd.SDP, "\n") {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "a=fingerprint:") {
+				fps = append(fps, strings.ToLower(strings.TrimPrefix(line, "a=fingerprint:")))
+			}
+		}
+	}
+	sort.Strings(fps)
+	return []byte(strings.Join(fps, "\n"))
+}
+
 // internal access for the datachannel wrapper
 func (p *Peer) getDataChannel() *webrtc.DataChannel { return p.dc }
 
@@ -2,6 +2,7 @@ package connections
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"sync"
@@ -11,9 +12,12 @@ import (
 )
 
 // dcConn adapts a WebRTC DataChannel to a stream-like net.Conn for reuse of transfer utilities.
+// msgs is never closed: Pion may still deliver a message while the channel closes, so the end
+// is signalled by closing done instead.
 type dcConn struct {
 	dc     *webrtc.DataChannel
 	msgs   chan []byte
+	done   chan struct{} // closed once the channel is closed, by either side
 	cur    []byte
 	mu     sync.Mutex
 	closed bool
@@ -32,6 +36,7 @@ func newDCConn(dc *webrtc.DataChannel) *dcConn {
 	c := &dcConn{
 		dc:    dc,
 		msgs:  make(chan []byte, 64),
+		done:  make(chan struct{}),
 		lowCh: make(chan struct{}, 1),
 	}
 	// Configure backpressure thresholds
@@ -42,11 +47,9 @@ func newDCConn(dc *webrtc.DataChannel) *dcConn {
 		// Copy buffer because msg.Data is reused by pion
 		b := make([]byte, len(msg.Data))
 		copy(b, msg.Data)
-		c.mu.Lock()
-		closed := c.closed
-		c.mu.Unlock()
-		if !closed {
-			c.msgs <- b
+		select {
+		case c.msgs <- b:
+		case <-c.done:
 		}
 	})
 	dc.OnBufferedAmountLow(func() {
@@ -56,12 +59,7 @@ func newDCConn(dc *webrtc.DataChannel) *dcConn {
 		}
 	})
 	dc.OnClose(func() {
-		c.mu.Lock()
-		if !c.closed {
-			c.closed = true
-			close(c.msgs)
-		}
-		c.mu.Unlock()
+		c.markClosed()
 		// wake waiters
 		select {
 		case c.lowCh <- struct{}{}:
@@ -92,13 +90,70 @@ func (p *Peer) DataChannelConn() (net.Conn, error) {
 	return newDCConn(dc), nil
 }
 
+// streamOpenTimeout bounds how long OpenStream waits for a new data channel to open.
+const streamOpenTimeout = 10 * time.Second
+
+// OpenStream opens an additional ordered, reliable data channel to the peer, for transfers
+// that spread one file over several streams. The peer receives it from AcceptStream.
+// Data channels share the peer connection's DTLS session, so no renegotiation is needed.
+func (p *Peer) OpenStream() (net.Conn, error) {
+	p.streamMu.Lock()
+	p.nstreams++
+	label := fmt.Sprintf("%s-%d", primaryLabel, p.nstreams)
+	p.streamMu.Unlock()
+	dc, err := p.pc.CreateDataChannel(label, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create data channel: %w", err)
+	}
+	c := newDCConn(dc)
+	open := make(chan struct{})
+	dc.OnOpen(func() { close(open) })
+	select {
+	case <-open:
+		return c, nil
+	case <-time.After(streamOpenTimeout):
+		_ = c.Close()
+		return nil, errors.New("data channel did not open")
+	}
+}
+
+// AcceptStream blocks until the peer opens another data channel with OpenStream.
+func (p *Peer) AcceptStream() (net.Conn, error) {
+	c, ok := <-p.streams
+	if !ok {
+		return nil, io.EOF
+	}
+	return c, nil
+}
+
+// queueStream hands a data channel opened by the remote side to AcceptStream once it is open.
+// Channels beyond the backlog are closed rather than blocking Pion's callbacks.
+func (p *Peer) queueStream(dc *webrtc.DataChannel) {
+	c := newDCConn(dc)
+	dc.OnOpen(func() {
+		select {
+		case p.streams <- c:
+		default:
+			_ = c.Close()
+		}
+	})
+}
+
+// Read returns the messages received before the channel closed, then io.EOF.
 func (c *dcConn) Read(p []byte) (int, error) {
 	for len(c.cur) == 0 {
-		b, ok := <-c.msgs
-		if !ok {
+		select {
+		case b := <-c.msgs:
+			c.cur = b
+			continue
+		default:
+		}
+		select {
+		case b := <-c.msgs:
+			c.cur = b
+		case <-c.done:
 			return 0, io.EOF
 		}
-		c.cur = b
 	}
 	n := copy(p, c.cur)
 	c.cur = c.cur[n:]
@@ -141,15 +196,22 @@ func (c *dcConn) Write(p []byte) (int, error) {
 }
 
 func (c *dcConn) Close() error {
+	if !c.markClosed() {
+		return nil
+	}
+	return c.dc.Close()
+}
+
+// markClosed records that the channel is closed and reports whether it was still open.
+func (c *dcConn) markClosed() bool {
 	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.closed {
-		c.mu.Unlock()
-		return nil
+		return false
 	}
 	c.closed = true
-	close(c.msgs)
-	c.mu.Unlock()
-	return c.dc.Close()
+	close(c.done)
+	return true
 }
 
 // Minimal net.Conn plumbing
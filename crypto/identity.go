@@ -0,0 +1,107 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Identity is a node's long-lived Ed25519 signing key. It signs the ephemeral
+// key shares of every transfer so peers can recognise the node across runs.
+type Identity struct {
+	priv ed25519.PrivateKey
+}
+
+// LoadOrCreateIdentity reads the PEM (PKCS#8) identity key at path, creating a new one
+// with 0600 permissions if the file does not exist.
+func LoadOrCreateIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "PRIVATE KEY" {
+			return nil, fmt.Errorf("identity %s: no PEM private key", path)
+		}
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("identity %s: %w", path, err)
+		}
+		priv, ok := k.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("identity %s: not an Ed25519 key", path)
+		}
+		return &Identity{priv: priv}, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	id, err := GenerateIdentity()
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(id.priv)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// GenerateIdentity returns a new in-memory identity.
+func GenerateIdentity() (*Identity, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{priv: priv}, nil
+}
+
+var (
+	processIdentity     *Identity
+	processIdentityOnce sync.Once
+	processIdentityErr  error
+)
+
+// ProcessIdentity returns a throwaway identity shared by the whole process, for callers
+// that did not configure a persistent one.
+func ProcessIdentity() (*Identity, error) {
+	processIdentityOnce.Do(func() {
+		processIdentity, processIdentityErr = GenerateIdentity()
+	})
+	return processIdentity, processIdentityErr
+}
+
+// PublicKey returns the raw 32-byte Ed25519 public key.
+func (id *Identity) PublicKey() []byte { return id.priv.Public().(ed25519.PublicKey) }
+
+// Fingerprint returns the identity's fingerprint ("SHA256:<base64>").
+func (id *Identity) Fingerprint() string { return Fingerprint(id.PublicKey()) }
+
+// Sign signs msg with the identity key.
+func (id *Identity) Sign(msg []byte) []byte { return ed25519.Sign(id.priv, msg) }
+
+// VerifyIdentity checks an Ed25519 signature by the raw public key pub.
+func VerifyIdentity(pub, msg, sig []byte) bool {
+	if len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(pub), msg, sig)
+}
+
+// Fingerprint formats a public key fingerprint the way ssh does: SHA256:<unpadded base64>.
+func Fingerprint(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,137 @@
+package crypto
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// ErrPeerKeyChanged is returned when a known peer presents a different identity key.
+var ErrPeerKeyChanged = errors.New("peer identity key changed")
+
+// ErrInvalidPeerName is returned for a peer name the store cannot hold.
+var ErrInvalidPeerName = errors.New("invalid peer name")
+
+// ValidPeerName checks that name fits one field of the known-peers file: it must be non-empty
+// and free of whitespace and control characters, which would let a peer plant extra pins or
+// make the file unreadable, and must not start with '#', which would make its line a comment
+// and lose the pin on the next load.
+func ValidPeerName(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: empty", ErrInvalidPeerName)
+	}
+	if strings.HasPrefix(name, "#") {
+		return fmt.Errorf("%w %q: starts with '#'", ErrInvalidPeerName, name)
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return fmt.Errorf("%w %q: whitespace or control character", ErrInvalidPeerName, name)
+		}
+	}
+	return nil
+}
+
+// KnownPeers is a trust-on-first-use store mapping node names to identity fingerprints.
+// The file holds one "<name> <fingerprint>" pair per line.
+type KnownPeers struct {
+	path  string
+	mu    sync.Mutex
+	peers map[string]string
+}
+
+// LoadKnownPeers reads the known-peers file at path; a missing file is an empty store.
+func LoadKnownPeers(path string) (*KnownPeers, error) {
+	kp := &KnownPeers{path: path, peers: make(map[string]string)}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return kp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s: malformed line %q", path, line)
+		}
+		kp.peers[parts[0]] = parts[1]
+	}
+	return kp, sc.Err()
+}
+
+// PeerStatus is the outcome of checking a peer against the store.
+type PeerStatus int
+
+const (
+	PeerKnown   PeerStatus = iota // fingerprint matches the pin
+	PeerNew                       // first contact; the fingerprint has been pinned
+	PeerChanged                   // mismatch accepted via allowChange; the pin was replaced
+)
+
+// Verify checks fingerprint fp for peer name. Unknown peers are pinned and saved; a name
+// ValidPeerName rejects is never stored.
+// A mismatch returns ErrPeerKeyChanged unless allowChange is set, in which case the new key
+// replaces the old pin.
+func (kp *KnownPeers) Verify(name, fp string, allowChange bool) (PeerStatus, error) {
+	if err := ValidPeerName(name); err != nil {
+		return PeerKnown, err
+	}
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	old, ok := kp.peers[name]
+	switch {
+	case !ok:
+		kp.peers[name] = fp
+		return PeerNew, kp.save()
+	case old == fp:
+		return PeerKnown, nil
+	case !allowChange:
+		return PeerKnown, fmt.Errorf("%w: %s was pinned as %s but presented %s", ErrPeerKeyChanged, name, old, fp)
+	default:
+		kp.peers[name] = fp
+		return PeerChanged, kp.save()
+	}
+}
+
+// save rewrites the file atomically; callers hold kp.mu. Each save writes a temporary file
+// of its own, so saves from stores loaded separately never write into each other's.
+func (kp *KnownPeers) save() error {
+	names := make([]string, 0, len(kp.peers))
+	for n := range kp.peers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, n := range names {
+		fmt.Fprintf(&sb, "%s %s\n", n, kp.peers[n])
+	}
+	dir := filepath.Dir(kp.path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(kp.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+	if _, err := tmp.WriteString(sb.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), kp.path)
+}
@@ -0,0 +1,113 @@
+package crypto
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKnownPeersRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_peers")
+	kp, err := LoadKnownPeers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pins := map[string]string{"alice": "SHA256:a", "bob": "SHA256:b", "node-\u00fc.local": "SHA256:c"}
+	for name, fp := range pins {
+		if st, err := kp.Verify(name, fp, false); err != nil || st != PeerNew {
+			t.Fatalf("Verify(%q) = %v, %v; want PeerNew", name, st, err)
+		}
+	}
+	if _, err := kp.Verify("bob", "SHA256:new", true); err != nil {
+		t.Fatal(err)
+	}
+	pins["bob"] = "SHA256:new"
+
+	again, err := LoadKnownPeers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, fp := range pins {
+		if st, err := again.Verify(name, fp, false); err != nil || st != PeerKnown {
+			t.Fatalf("after reload Verify(%q) = %v, %v; want PeerKnown", name, st, err)
+		}
+		if _, err := again.Verify(name, "SHA256:other", false); !errors.Is(err, ErrPeerKeyChanged) {
+			t.Fatalf("after reload %q with another key: %v; want ErrPeerKeyChanged", name, err)
+		}
+	}
+}
+
+func TestKnownPeersRefusesNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_peers")
+	kp, err := LoadKnownPeers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"", "#bob", "a b", "a\tb", "a\nmallory SHA256:m", "a\x1b[2J", "a\u00a0b", "a\ufffd"} {
+		if _, err := kp.Verify(name, "SHA256:x", false); !errors.Is(err, ErrInvalidPeerName) {
+			t.Errorf("Verify(%q) = %v; want ErrInvalidPeerName", name, err)
+		}
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("refused names were saved: %v", err)
+	}
+}
+
+func TestLoadKnownPeersComments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_peers")
+	data := "# pinned peers\n\nalice SHA256:a\n  # indented comment\nbob SHA256:b\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	kp, err := LoadKnownPeers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, fp := range map[string]string{"alice": "SHA256:a", "bob": "SHA256:b"} {
+		if st, err := kp.Verify(name, fp, false); err != nil || st != PeerKnown {
+			t.Fatalf("Verify(%q) = %v, %v; want PeerKnown", name, st, err)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("alice SHA256:a extra\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKnownPeers(path); err == nil {
+		t.Fatal("malformed line accepted")
+	}
+}
+
+func TestKnownPeersConcurrentSaves(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "known_peers")
+	done := make(chan error)
+	for i := range 8 {
+		go func() {
+			kp, err := LoadKnownPeers(path)
+			if err == nil {
+				_, err = kp.Verify("peer"+string(rune('a'+i)), "SHA256:x", false)
+			}
+			done <- err
+		}()
+	}
+	for range 8 {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	kp, err := LoadKnownPeers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kp.peers) == 0 {
+		t.Fatal("no pin saved")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("temporary files left behind: %v", entries)
+	}
+}
@@ -0,0 +1,147 @@
+package crypto
+
+import (
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+)
+
+// SPAKE2 over P-256 as described in RFC 9382. Both sides prove knowledge of a shared
+// password without revealing it and end up with a shared key; an eavesdropper learns
+// nothing, and an active attacker gets a single online guess per run.
+//
+// The point arithmetic uses crypto/elliptic although it is deprecated: SPAKE2 needs point
+// addition and scalar multiplication of arbitrary points, which crypto/ecdh does not offer,
+// and the standard library has no other public API for it. For P-256 these functions are
+// still backed by the constant-time implementation crypto/ecdh uses. Peer points are only
+// accepted through UnmarshalCompressed, which rejects anything that is not on the curve.
+
+// PAKERole selects which SPAKE2 blinding point a side uses.
+type PAKERole int
+
+const (
+	PAKEClient PAKERole = iota // "A": the side that dials
+	PAKEServer                 // "B": the side that accepts
+)
+
+// RFC 9382 section 6 constants for P-256.
+var (
+	spakeCurve       = elliptic.P256()
+	spakeMx, spakeMy = mustPoint("02886e2f97ace46e55ba9dd7242579f2993b64e16ef3dcab95afd497333d8fa12f")
+	spakeNx, spakeNy = mustPoint("03d8bbd6c639c62937b04d997f38c3770719c629d7014d49a24b4f98baa1292b49")
+)
+
+func mustPoint(s string) (*big.Int, *big.Int) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	x, y := elliptic.UnmarshalCompressed(spakeCurve, b)
+	if x == nil {
+		panic("spake2: invalid constant point")
+	}
+	return x, y
+}
+
+// SPAKE2 holds one side's state between sending its message and receiving the peer's.
+type SPAKE2 struct {
+	role PAKERole
+	w, x *big.Int
+	msg  []byte
+}
+
+// PAKEKeys is the outcome of a SPAKE2 run.
+type PAKEKeys struct {
+	Key         []byte // 32-byte shared secret
+	Confirm     []byte // our key confirmation MAC, to send to the peer
+	peerConfirm []byte
+}
+
+// VerifyPeer reports whether mac is the peer's expected key confirmation.
+func (k PAKEKeys) VerifyPeer(mac []byte) bool { return hmac.Equal(mac, k.peerConfirm) }
+
+// NewSPAKE2 starts a SPAKE2 run for role with the given password.
+func NewSPAKE2(role PAKERole, password string) (*SPAKE2, error) {
+	n := spakeCurve.Params().N
+	x, err := rand.Int(rand.Reader, new(big.Int).Sub(n, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+	x.Add(x, big.NewInt(1))
+	w := passwordScalar(password)
+
+	mx, my := spakeMx, spakeMy
+	if role == PAKEServer {
+		mx, my = spakeNx, spakeNy
+	}
+	gx, gy := spakeCurve.ScalarBaseMult(x.Bytes())
+	wx, wy := spakeCurve.ScalarMult(mx, my, w.Bytes())
+	tx, ty := spakeCurve.Add(gx, gy, wx, wy)
+	return &SPAKE2{role: role, w: w, x: x, msg: elliptic.MarshalCompressed(spakeCurve, tx, ty)}, nil
+}
+
+// Message returns the compressed point to send to the peer.
+func (s *SPAKE2) Message() []byte { return s.msg }
+
+// Finish consumes the peer's message and derives the shared key and confirmation MACs.
+// idA and idB name the client and server respectively and are bound into the transcript.
+func (s *SPAKE2) Finish(peerMsg []byte, idA, idB string) (PAKEKeys, error) {
+	px, py := elliptic.UnmarshalCompressed(spakeCurve, peerMsg)
+	if px == nil {
+		return PAKEKeys{}, errors.New("spake2: invalid peer message")
+	}
+	// Remove the peer's blinding: Z = peer - w*N (client) or peer - w*M (server)
+	mx, my := spakeNx, spakeNy
+	if s.role == PAKEServer {
+		mx, my = spakeMx, spakeMy
+	}
+	wx, wy := spakeCurve.ScalarMult(mx, my, s.w.Bytes())
+	wy.Sub(spakeCurve.Params().P, wy)
+	zx, zy := spakeCurve.Add(px, py, wx, wy)
+	kx, ky := spakeCurve.ScalarMult(zx, zy, s.x.Bytes())
+	if kx.Sign() == 0 && ky.Sign() == 0 {
+		return PAKEKeys{}, errors.New("spake2: degenerate shared point")
+	}
+
+	pA, pB := s.msg, peerMsg
+	if s.role == PAKEServer {
+		pA, pB = peerMsg, s.msg
+	}
+	var tt []byte
+	for _, part := range [][]byte{
+		[]byte(idA), []byte(idB), pA, pB,
+		elliptic.MarshalCompressed(spakeCurve, kx, ky),
+		s.w.Bytes(),
+	} {
+		tt = binary.LittleEndian.AppendUint64(tt, uint64(len(part)))
+		tt = append(tt, part...)
+	}
+	sum := sha512.Sum512(tt)
+	ke, ka := sum[:32], sum[32:]
+	kc, err := hkdf.Key(sha256.New, ka, nil, "ConfirmationKeys", 64)
+	if err != nil {
+		return PAKEKeys{}, err
+	}
+	macA := hmac.New(sha256.New, kc[:32])
+	macA.Write(tt)
+	macB := hmac.New(sha256.New, kc[32:])
+	macB.Write(tt)
+	keys := PAKEKeys{Key: ke, Confirm: macA.Sum(nil), peerConfirm: macB.Sum(nil)}
+	if s.role == PAKEServer {
+		keys.Confirm, keys.peerConfirm = keys.peerConfirm, keys.Confirm
+	}
+	return keys, nil
+}
+
+// passwordScalar maps the password to a scalar w modulo the group order.
+func passwordScalar(password string) *big.Int {
+	h := sha512.Sum512([]byte("learnP2P SPAKE2 password\x00" + password))
+	return new(big.Int).Mod(new(big.Int).SetBytes(h[:]), spakeCurve.Params().N)
+}
@@ -0,0 +1,114 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"math/big"
+	"testing"
+)
+
+// spakeRun runs both sides of SPAKE2 and returns their keys.
+func spakeRun(t *testing.T, clientPassword, serverPassword string) (client, server PAKEKeys) {
+	t.Helper()
+	a, err := NewSPAKE2(PAKEClient, clientPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewSPAKE2(PAKEServer, serverPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client, err = a.Finish(b.Message(), "alice", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if server, err = b.Finish(a.Message(), "alice", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestSPAKE2RoundTrip(t *testing.T) {
+	client, server := spakeRun(t, "correct horse", "correct horse")
+	if len(client.Key) != 32 || !bytes.Equal(client.Key, server.Key) {
+		t.Fatalf("keys differ: %x / %x", client.Key, server.Key)
+	}
+	if !client.VerifyPeer(server.Confirm) || !server.VerifyPeer(client.Confirm) {
+		t.Fatal("key confirmation failed with the same password")
+	}
+	if bytes.Equal(client.Confirm, server.Confirm) {
+		t.Fatal("both sides send the same confirmation")
+	}
+
+	// Every run draws fresh scalars
+	again, _ := spakeRun(t, "correct horse", "correct horse")
+	if bytes.Equal(again.Key, client.Key) {
+		t.Fatal("two runs derived the same key")
+	}
+}
+
+func TestSPAKE2WrongPassword(t *testing.T) {
+	client, server := spakeRun(t, "correct horse", "battery staple")
+	if bytes.Equal(client.Key, server.Key) {
+		t.Fatal("different passwords derived the same key")
+	}
+	if client.VerifyPeer(server.Confirm) || server.VerifyPeer(client.Confirm) {
+		t.Fatal("key confirmation passed with a wrong password")
+	}
+}
+
+func TestSPAKE2IdentitiesBound(t *testing.T) {
+	a, _ := NewSPAKE2(PAKEClient, "pw")
+	b, _ := NewSPAKE2(PAKEServer, "pw")
+	client, err := a.Finish(b.Message(), "alice", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := b.Finish(a.Message(), "alice", "mallory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.VerifyPeer(server.Confirm) {
+		t.Fatal("key confirmation passed for different identities")
+	}
+}
+
+func TestSPAKE2RejectsInvalidPoints(t *testing.T) {
+	s, err := NewSPAKE2(PAKEClient, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := spakeCurve.Params().P
+	// An x coordinate with no point on the curve
+	var offCurve []byte
+	for x := int64(1); offCurve == nil; x++ {
+		b := append([]byte{0x02}, new(big.Int).SetInt64(x).FillBytes(make([]byte, 32))...)
+		if px, _ := elliptic.UnmarshalCompressed(spakeCurve, b); px == nil {
+			offCurve = b
+		}
+	}
+	valid := s.Message()
+	uncompressed := elliptic.Marshal(spakeCurve, spakeMx, spakeMy)
+	for name, msg := range map[string][]byte{
+		"empty":          nil,
+		"identity":       {0x00},
+		"truncated":      valid[:len(valid)-1],
+		"bad prefix":     append([]byte{0x05}, valid[1:]...),
+		"uncompressed":   uncompressed,
+		"off curve":      offCurve,
+		"x not below p":  append([]byte{0x02}, p.FillBytes(make([]byte, 32))...),
+		"x all ones":     append([]byte{0x03}, bytes.Repeat([]byte{0xff}, 32)...),
+		"trailing bytes": append(append([]byte{}, valid...), 0),
+	} {
+		if _, err := s.Finish(msg, "alice", "bob"); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	// A peer that knows the password can send exactly w*N, which would cancel out to the
+	// point at infinity; that must not yield a key
+	w := passwordScalar("pw")
+	nx, ny := spakeCurve.ScalarMult(spakeNx, spakeNy, w.Bytes())
+	if _, err := s.Finish(elliptic.MarshalCompressed(spakeCurve, nx, ny), "alice", "bob"); err == nil {
+		t.Error("degenerate shared point accepted")
+	}
+}
@@ -0,0 +1,36 @@
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+)
+
+// X25519KeySize is the length of an encoded X25519 public key in bytes.
+const X25519KeySize = 32
+
+// GenerateX25519 returns a fresh ephemeral X25519 key pair.
+func GenerateX25519() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// ParseX25519PublicKey parses a 32-byte X25519 public key.
+func ParseX25519PublicKey(b []byte) (*ecdh.PublicKey, error) {
+	return ecdh.X25519().NewPublicKey(b)
+}
+
+// DeriveSessionKey runs X25519 between priv and peer and expands the shared secret with
+// HKDF-SHA256 into an AES-256 key and a GCM base nonce. salt should bind both public keys.
+// A non-empty psk (e.g. a PAKE key) is appended to the secret so the result also depends on it.
+func DeriveSessionKey(priv *ecdh.PrivateKey, peer *ecdh.PublicKey, psk, salt []byte, info string) (key, baseNonce []byte, err error) {
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	okm, err := hkdf.Key(sha256.New, append(shared, psk...), salt, info, KeySize+NonceSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return okm[:KeySize], okm[KeySize:], nil
+}
@@ -5,6 +5,8 @@ go 1.24.6
 require (
 	github.com/grandcat/zeroconf v1.0.0
 	github.com/pion/webrtc/v4 v4.1.4
+	golang.org/x/net v0.35.0
+	golang.org/x/sys v0.30.0
 )
 
 require (
@@ -28,6 +30,4 @@ require (
 	github.com/pion/turn/v4 v4.1.1 // indirect
 	github.com/wlynxg/anet v0.0.5 // indirect
 	golang.org/x/crypto v0.33.0 // indirect
-	golang.org/x/net v0.35.0 // indirect
-	golang.org/x/sys v0.30.0 // indirect
 )
@@ -3,15 +3,23 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"learnP2P/connections"
+	pcrypto "learnP2P/crypto"
 	"learnP2P/transfer"
 )
 
@@ -25,8 +33,80 @@ func main() {
 	portFlag := flag.Int("port", 8000, "Port to expose for local discovery")
 	nameFlag := flag.String("name", "", "Node name to expose (default: COMPUTERNAME)")
 	passwordFlag := flag.String("password", "", "Password for local connection authentication (required to connect)")
+	receiveDir := flag.String("receive-dir", transfer.PublicDir, "Directory received files are stored under")
+	peerDirs := map[string]string{}
+	flag.Func("peer-dir", "Receive directory for one peer as <peer-name>=<dir> (repeatable)", func(v string) error {
+		peer, dir, ok := strings.Cut(v, "=")
+		if !ok || peer == "" || dir == "" {
+			return fmt.Errorf("want <peer-name>=<dir>")
+		}
+		peerDirs[peer] = dir
+		return nil
+	})
+	onConflict := flag.String("on-conflict", "rename", "When a received name already exists: rename, overwrite, skip-identical or reject")
+	onAbort := flag.String("on-abort", "keep", "Partial data of a received file whose transfer was canceled by either side: keep (to resume later) or delete")
+	escapingLinks := flag.String("escaping-links", "skip", "Symlinks in a sent directory that point outside it: skip, follow (send the file) or keep; a receiver only creates them with keep")
+	metadata := flag.String("metadata", "honor", "Apply the sender's permission bits and modification time to received files: honor, honor-owner (also owner and group, as root) or ignore")
+	deltaFlag := flag.Bool("delta", false, "Receive a file whose name already exists as a delta against the existing copy (only changed blocks are sent)")
+	acceptAll := flag.Bool("accept-all", false, "Accept every incoming transfer without asking")
+	autoFrom := flag.String("auto-accept-from", "", "Comma-separated peer names whose transfers are accepted without asking")
+	autoMaxSize := flag.String("auto-accept-max-size", "", "Accept transfers up to this size without asking (e.g. 500K, 20M, 1G)")
+	autoExt := flag.String("auto-accept-ext", "", "Comma-separated extensions (e.g. .txt,.pdf) accepted without asking; every file must match")
+	acceptTimeout := flag.Duration("accept-timeout", 2*time.Minute, "Decline an incoming transfer nobody answered within this time (0 = wait forever)")
+	ackEvery := flag.String("ack-every", "", "Acknowledge received data to the sender every N bytes (e.g. 8M) so its progress shows delivered bytes")
+	compression := flag.String("compression", transfer.CompressDeflate, "Chunk compression to offer or accept: deflate or none")
+	maxPeers := flag.Int("max-peers", 4, "Maximum number of peers connected, and of transfers received, at once (0 = unlimited)")
+	streams := flag.Int("streams", 1, "Send large files over this many TCP connections or WebRTC data channels at once")
+	maxStreams := flag.Int("max-streams", 4, "Most connections a sender may use for one file received here (1 = no parallel transfers)")
+	identityDir := flag.String("identity-dir", "", "Directory holding this node's identity key and known_peers (default: <user config dir>/learnP2P/<name>)")
+	acceptChangedKey := flag.Bool("accept-changed-key", false, "Trust and re-pin a known peer whose identity key has changed")
+	signalListen := flag.String("signal-listen", "", "Run only a signaling server on this address (e.g. :8080)")
+	signalURL := flag.String("signal-url", "", "Signaling server URL (e.g. ws://192.168.1.10:8080); replaces OFFER/ANSWER copy-paste")
+	roomFlag := flag.String("room", "", "Signaling room name shared by both peers (with --signal-url)")
+	noTrickle := flag.Bool("no-trickle", false, "With --signal-url, wait for full ICE gathering instead of trickling candidates")
+	iceConfigFlag := flag.String("ice-config", "", "JSON file with WebRTC ICE servers and policy (env LEARNP2P_ICE_CONFIG)")
+	stunFlag := flag.String("stun", "", "Comma-separated STUN URLs, e.g. stun:stun.example.org:3478 (env LEARNP2P_STUN)")
+	turnFlag := flag.String("turn", "", "Comma-separated TURN URLs, e.g. turn:turn.example.org:3478?transport=tcp (env LEARNP2P_TURN)")
+	turnUser := flag.String("turn-user", "", "TURN username (env LEARNP2P_TURN_USERNAME)")
+	turnCred := flag.String("turn-credential", "", "TURN credential (env LEARNP2P_TURN_CREDENTIAL)")
+	icePolicy := flag.String("ice-policy", "", "WebRTC ICE transport policy: all or relay (TURN only)")
+	lanOnly := flag.Bool("lan-only", false, "WebRTC with host candidates only; no STUN/TURN server is contacted")
+	sendFlag := flag.String("send", "", "Send this file or directory (- for standard input) to --peer without the interactive prompt, then exit (TCP mode)")
+	peerFlag := flag.String("peer", "", "Node name to send to with --send")
+	peerPassword := flag.String("peer-password", "", "Password of --peer")
+	streamName := flag.String("stream-name", "stdin", "File name announced for data sent from standard input")
+	shareDir := flag.String("share", "", "Directory connected peers may list and pull files from ('ls' and 'get'); read-only")
+	outputFlag := flag.String("output", "", "Write the next received file to this path (- for standard output) instead of the receive directory, then exit")
 	flag.Parse()
 
+	if *signalListen != "" {
+		log.Fatal(connections.ListenAndServeSignaling(*signalListen))
+	}
+	if *signalURL != "" && *roomFlag == "" {
+		log.Fatal("--signal-url requires --room")
+	}
+	webrtcMode := *webrtcFlag || *webrtcSend || *webrtcRecv
+	if *sendFlag != "" && (*peerFlag == "" || webrtcMode) {
+		log.Fatal("--send requires --peer and works in TCP mode only")
+	}
+
+	// With --output -, standard output carries the received data, so everything the program
+	// prints goes to standard error instead
+	var output io.Writer
+	switch *outputFlag {
+	case "":
+	case "-":
+		output = os.Stdout
+		os.Stdout = os.Stderr
+	default:
+		f, err := os.Create(*outputFlag)
+		if err != nil {
+			log.Fatalf("Failed to create --output: %v", err)
+		}
+		defer f.Close()
+		output = f
+	}
+
 	baseName := os.Getenv("COMPUTERNAME")
 	if baseName == "" {
 		baseName = "Node"
@@ -35,10 +115,92 @@ func main() {
 	if name == "" {
 		name = "P2PNode2-" + strings.ReplaceAll(baseName, " ", "-")
 	}
+	if err := pcrypto.ValidPeerName(name); err != nil {
+		log.Fatalf("Invalid --name: %v", err)
+	}
 	port := *portFlag
 
+	// Long-lived identity key and trust-on-first-use store
+	idDir := *identityDir
+	if idDir == "" {
+		cfgDir, err := os.UserConfigDir()
+		if err != nil {
+			log.Fatalf("Could not locate config dir (use --identity-dir): %v", err)
+		}
+		idDir = filepath.Join(cfgDir, "learnP2P", name)
+	}
+	identity, err := pcrypto.LoadOrCreateIdentity(filepath.Join(idDir, "identity.key"))
+	if err != nil {
+		log.Fatalf("Failed to load identity: %v", err)
+	}
+	knownPeers, err := pcrypto.LoadKnownPeers(filepath.Join(idDir, "known_peers"))
+	if err != nil {
+		log.Fatalf("Failed to load known peers: %v", err)
+	}
+	fmt.Printf("Node identity: %s (%s)\n", identity.Fingerprint(), idDir)
+	conflict, err := transfer.ParseConflictPolicy(*onConflict)
+	if err != nil {
+		log.Fatalf("Invalid --on-conflict: %v", err)
+	}
+	partial, err := transfer.ParsePartialPolicy(*onAbort)
+	if err != nil {
+		log.Fatalf("Invalid --on-abort: %v", err)
+	}
+	linkPolicy, err := transfer.ParseLinkPolicy(*escapingLinks)
+	if err != nil {
+		log.Fatalf("Invalid --escaping-links: %v", err)
+	}
+	metaPolicy, err := transfer.ParseMetadataPolicy(*metadata)
+	if err != nil {
+		log.Fatalf("Invalid --metadata: %v", err)
+	}
+	rules, err := acceptRules(*autoFrom, *autoMaxSize, *autoExt)
+	if err != nil {
+		log.Fatalf("Invalid auto-accept rule: %v", err)
+	}
+	codec, err := transfer.ParseCompression(*compression)
+	if err != nil {
+		log.Fatalf("Invalid --compression: %v", err)
+	}
+	var ackBytes int64
+	if *ackEvery != "" {
+		if ackBytes, err = parseSize(*ackEvery); err != nil {
+			log.Fatalf("Invalid --ack-every: %v", err)
+		}
+	}
+	opts := transfer.Options{
+		Name:             name,
+		Identity:         identity,
+		KnownPeers:       knownPeers,
+		AcceptChangedKey: *acceptChangedKey,
+		ReceiveDir:       *receiveDir,
+		PeerDirs:         peerDirs,
+		AutoAccept:       rules,
+		AckEvery:         ackBytes,
+		Compression:      codec,
+		OnConflict:       conflict,
+		OnAbort:          partial,
+		Delta:            *deltaFlag,
+		Metadata:         metaPolicy,
+		EscapingLinks:    linkPolicy,
+		Streams:          *streams,
+		MaxStreams:       *maxStreams,
+		Output:           output,
+		Share:            *shareDir,
+	}
+	if *shareDir != "" {
+		if fi, err := os.Stat(*shareDir); err != nil || !fi.IsDir() {
+			log.Fatalf("--share must be a directory: %v", *shareDir)
+		}
+		fmt.Printf("Sharing %s (read-only)\n", *shareDir)
+	}
+	if !*acceptAll {
+		opts.ConfirmOffer = confirmOffer(*acceptTimeout)
+	}
+	receiving = newLimiter(*maxPeers)
+
 	// If WebRTC mode is requested, do not expose via mDNS
-	if *webrtcFlag || *webrtcSend || *webrtcRecv {
+	if webrtcMode {
 		// If explicit role flags provided, use them; otherwise ask interactively
 		role := 0
 		if *webrtcSend && *webrtcRecv {
@@ -49,6 +211,20 @@ func main() {
 			role = 2
 		}
 
+		ice, err := iceConfig(*iceConfigFlag, *stunFlag, *turnFlag, *turnUser, *turnCred)
+		if err != nil {
+			log.Fatalf("Invalid ICE configuration: %v", err)
+		}
+		if *icePolicy != "" {
+			ice.Policy = *icePolicy
+		}
+		ice.LANOnly = ice.LANOnly || *lanOnly
+		if ice.LANOnly {
+			fmt.Println("ICE: LAN only (host candidates, no STUN/TURN)")
+		} else if ice.Servers != nil {
+			fmt.Printf("ICE: %d configured server(s)\n", len(ice.Servers))
+		}
+
 		if role == 0 { // interactive fallback
 			fmt.Println("WebRTC mode: no mDNS exposure. Choose a role: [1] Sender (create offer)  [2] Receiver (paste offer)")
 			fmt.Print("Enter 1 or 2: ")
@@ -60,31 +236,37 @@ func main() {
 
 		switch role {
 		case 1:
-			// Sender: generate offer, print base64, then accept pasted answer
-			offerB64, peer, err := connections.GenerateOffer()
-			if err != nil {
-				log.Fatalf("Failed to generate offer: %v", err)
-			}
-			fmt.Println("\n--- SEND THIS OFFER TO THE RECEIVER ---")
-			fmt.Println(offerB64)
-			fmt.Println("--- END OFFER ---")
-
-			var ansB64 string
-			if *answerFile != "" {
-				data, err := os.ReadFile(*answerFile)
+			var peer *connections.Peer
+			if *signalURL != "" {
+				peer = joinSignaling(*signalURL, *roomFlag, ice, true, !*noTrickle)
+			} else {
+				// Sender: generate offer, print base64, then accept pasted answer
+				offerB64, p, err := connections.GenerateOffer(ice)
 				if err != nil {
-					log.Fatalf("Failed to read --answer-file: %v", err)
+					log.Fatalf("Failed to generate offer: %v", err)
 				}
-				ansB64 = strings.TrimSpace(string(data))
-			} else {
-				fmt.Print("Paste receiver ANSWER and press Enter:\n> ")
-				ansB64 = strings.TrimSpace(readLine())
-			}
-			if ansB64 == "" {
-				log.Fatal("Empty ANSWER provided")
-			}
-			if err := connections.AcceptAnswer(peer, ansB64); err != nil {
-				log.Fatalf("Failed to accept answer: %v", err)
+				fmt.Println("\n--- SEND THIS OFFER TO THE RECEIVER ---")
+				fmt.Println(offerB64)
+				fmt.Println("--- END OFFER ---")
+
+				var ansB64 string
+				if *answerFile != "" {
+					data, err := os.ReadFile(*answerFile)
+					if err != nil {
+						log.Fatalf("Failed to read --answer-file: %v", err)
+					}
+					ansB64 = strings.TrimSpace(string(data))
+				} else {
+					fmt.Print("Paste receiver ANSWER and press Enter:\n> ")
+					ansB64 = strings.TrimSpace(readLine())
+				}
+				if ansB64 == "" {
+					log.Fatal("Empty ANSWER provided")
+				}
+				if err := connections.AcceptAnswer(p, ansB64); err != nil {
+					log.Fatalf("Failed to accept answer: %v", err)
+				}
+				peer = p
 			}
 
 			// Wait for connection
@@ -99,47 +281,45 @@ func main() {
 			if err != nil {
 				log.Fatalf("data channel not ready: %v", err)
 			}
-			for {
-				fmt.Print("Enter 'send <path>' to transfer a file, or 'quit' to exit: ")
-				cmd := strings.TrimSpace(readLine())
-				if cmd == "quit" {
-					_ = conn.Close()
-					return
-				}
-				if strings.HasPrefix(cmd, "send ") {
-					path := strings.TrimSpace(strings.TrimPrefix(cmd, "send "))
-					if err := transfer.Send(conn, path); err != nil {
-						log.Printf("File send failed: %v", err)
-						_ = conn.Close()
-						return
-					}
-					log.Println("File transfer complete (webrtc sender)")
-				}
-			}
+			opts.ChannelBinding = peer.ChannelBinding()
+			opts.ConfirmSAS = confirmSAS()
+			opts.OpenStream = peer.OpenStream
+			acceptStreamsAfterSAS(peer, &opts)
+			// Both ends can send once connected; the role only decided who offered
+			d := connections.NewMux(conn, true)
+			defer d.Close()
+			go serveMux(d, "WebRTC peer", opts, nil, nil)
+			runSession(d, "WebRTC peer", opts)
 
 		case 2:
-			// Receiver: paste offer, generate answer, print it
-			var offerB64 string
-			if *offerFile != "" {
-				data, err := os.ReadFile(*offerFile)
+			var peer *connections.Peer
+			if *signalURL != "" {
+				peer = joinSignaling(*signalURL, *roomFlag, ice, false, !*noTrickle)
+			} else {
+				// Receiver: paste offer, generate answer, print it
+				var offerB64 string
+				if *offerFile != "" {
+					data, err := os.ReadFile(*offerFile)
+					if err != nil {
+						log.Fatalf("Failed to read --offer-file: %v", err)
+					}
+					offerB64 = strings.TrimSpace(string(data))
+				} else {
+					fmt.Print("Paste sender OFFER and press Enter:\n> ")
+					offerB64 = strings.TrimSpace(readLine())
+				}
+				if offerB64 == "" {
+					log.Fatal("Empty OFFER provided")
+				}
+				ansB64, p, err := connections.AcceptOfferAndGenerateAnswer(offerB64, ice)
 				if err != nil {
-					log.Fatalf("Failed to read --offer-file: %v", err)
+					log.Fatalf("Failed to accept offer: %v", err)
 				}
-				offerB64 = strings.TrimSpace(string(data))
-			} else {
-				fmt.Print("Paste sender OFFER and press Enter:\n> ")
-				offerB64 = strings.TrimSpace(readLine())
+				fmt.Println("\n--- SEND THIS ANSWER BACK TO THE SENDER ---")
+				fmt.Println(ansB64)
+				fmt.Println("--- END ANSWER ---")
+				peer = p
 			}
-			if offerB64 == "" {
-				log.Fatal("Empty OFFER provided")
-			}
-			ansB64, peer, err := connections.AcceptOfferAndGenerateAnswer(offerB64)
-			if err != nil {
-				log.Fatalf("Failed to accept offer: %v", err)
-			}
-			fmt.Println("\n--- SEND THIS ANSWER BACK TO THE SENDER ---")
-			fmt.Println(ansB64)
-			fmt.Println("--- END ANSWER ---")
 
 			// Wait for connection
 			select {
@@ -159,15 +339,24 @@ func main() {
 			if err != nil {
 				log.Fatalf("data channel not ready: %v", err)
 			}
-			for {
-				man, path, err := transfer.Receive(conn)
-				if err != nil {
-					log.Printf("File receive ended: %v", err)
-					_ = conn.Close()
-					return
+			opts.ChannelBinding = peer.ChannelBinding()
+			opts.ConfirmSAS = confirmSAS()
+			opts.OpenStream = peer.OpenStream
+			acceptStreamsAfterSAS(peer, &opts)
+			d := connections.NewMux(conn, false)
+			defer d.Close()
+			if output != nil {
+				// With --output the first file received ends the program
+				done := make(chan error, 2)
+				cancelOnInterrupt(func() { done <- errCanceled })
+				go serveMux(d, "WebRTC peer", opts, func(err error) { done <- err }, nil)
+				if err := <-done; err != nil {
+					log.Fatalf("File receive failed: %v", err)
 				}
-				log.Printf("File transfer complete (webrtc receiver). Received %s -> %s\n", man.Name, path)
+				return
 			}
+			go serveMux(d, "WebRTC peer", opts, nil, nil)
+			runSession(d, "WebRTC peer", opts)
 
 		default:
 			log.Fatal("Invalid role; please run again and choose 1 or 2")
@@ -182,25 +371,36 @@ func main() {
 	}
 	fmt.Printf("Broadcasting as '%s' on port %d with IPs: %v\n", name, port, localIPs)
 
-	// Inbound acceptor to receive exactly one file per run
+	// Inbound acceptor: every authenticated peer gets its own receive loop
 	expectedPassword := *passwordFlag
 	if expectedPassword == "" {
 		expectedPassword = name // default expected password to node name
 	}
-	go func() {
-		conn, peer, err := connections.ListenAndAcceptOnce(name, port, expectedPassword)
-		if err != nil {
-			return
-		}
-		for {
-			man, path, err := transfer.Receive(conn)
-			if err != nil {
-				fmt.Printf("File receive ended from %s: %v\n", peer, err)
-				_ = conn.Close()
-				return
+	listener, err := connections.Listen(name, port, expectedPassword)
+	if err != nil {
+		log.Fatalf("Failed to listen on port %d: %v", port, err)
+	}
+	defer listener.Close()
+	// With --output the first file received ends the program
+	outputDone := make(chan error, 1)
+	var outputFinished func(error)
+	servePeers := *maxPeers
+	if output != nil {
+		servePeers = 1
+		outputFinished = func(err error) {
+			select {
+			case outputDone <- err:
+			default:
 			}
-			fmt.Printf("File transfer complete (receiver). Received %s -> %s\n", man.Name, path)
 		}
+	}
+	// Every connection is multiplexed: the peer can send to us, and we to it
+	go func() {
+		_ = listener.Serve(servePeers, func(conn net.Conn, peer string, release func()) {
+			d := connections.NewMux(conn, false)
+			defer d.Close()
+			serveMux(d, peer, opts, outputFinished, release)
+		})
 	}()
 
 	server, err := connections.StartMDNS(name, port)
@@ -208,6 +408,14 @@ func main() {
 		log.Fatalf("Failed to register mDNS: %v", err)
 	}
 	defer server.Shutdown()
+	if output != nil {
+		fmt.Println("Waiting for a file to write to --output... (Ctrl-C cancels)")
+		cancelOnInterrupt(func() { outputFinished(errCanceled) })
+		if err := <-outputDone; err != nil {
+			log.Fatalf("File receive failed: %v", err)
+		}
+		return
+	}
 
 	// Discover other nodes
 	fmt.Println("Discovering nodes on the local network...")
@@ -222,9 +430,18 @@ func main() {
 		fmt.Printf("(Self)     : %s\t%s\t%d\n", name, ip, port)
 	}
 
+	if *sendFlag != "" {
+		err := sendOnce(nodeCh, name, *peerFlag, *peerPassword, *sendFlag, *streamName, opts)
+		cancel()
+		if err != nil {
+			log.Fatalf("Send failed: %v", err)
+		}
+		return
+	}
+
 	// Optional: create a WebRTC offer (for future P2P signaling).
 	// Commented out to keep runtime simple; uncomment to test SDP generation.
-	// we, err := connections.NewWebRTC()
+	// we, err := connections.NewWebRTC(connections.ICEConfig{})
 	// if err == nil {
 	//     if sdp, e := we.CreateOffer(); e == nil {
 	//         fmt.Println("Local SDP offer (truncated):", sdp[:min(60, len(sdp))]+"...")
@@ -256,9 +473,13 @@ func main() {
 
 	// Simple REPL to choose a peer to connect to
 	for {
-		fmt.Print("\nEnter number to connect, 0 to list peers, or -1 to quit: ")
-		choiceStr := readLine()
-		choice, _ := strconv.Atoi(strings.TrimSpace(choiceStr))
+		fmt.Print("\nEnter number to connect, 0 to list peers, 'cancel' to stop incoming transfers, or -1 to quit: ")
+		choiceStr := strings.TrimSpace(readLine())
+		if choiceStr == "cancel" {
+			cancelAllTransfers()
+			continue
+		}
+		choice, _ := strconv.Atoi(choiceStr)
 		switch {
 		case choice == -1:
 			return
@@ -278,6 +499,8 @@ func main() {
 				continue
 			}
 			it := list[idx]
+			// A connection the peer opened to us is not reused: it only proved the dialer
+			// knows our password, not that it is the peer picked here
 			fmt.Printf("Connecting to %s at %s:%d...\n", it.Name, it.IP, it.Port)
 			// Prompt for password at connection time
 			fmt.Printf("Enter password for %s: ", it.Name)
@@ -288,35 +511,676 @@ func main() {
 				continue
 			}
 			fmt.Printf("Connected to %s successfully! You can keep this node running.\n", peerName)
+			opts.OpenStream = func() (net.Conn, error) {
+				return dialStream(it.IP, it.Port, name, pw)
+			}
 			// Stop discovery and further peer listing while connected
 			cancel()
-			// Loop to send multiple files over this open TCP connection
-			for {
-				fmt.Print("Enter 'send <path>' to transfer a file, or 'quit' to exit: ")
-				cmd := strings.TrimSpace(readLine())
-				if cmd == "quit" {
-					fmt.Println("Goodbye.")
-					conn.Close()
-					return
-				}
-				if strings.HasPrefix(cmd, "send ") {
-					path := strings.TrimSpace(strings.TrimPrefix(cmd, "send "))
-					if err := transfer.Send(conn, path); err != nil {
-						fmt.Printf("File send failed: %v\n", err)
-						conn.Close()
-						return
-					}
-					fmt.Println("File transfer complete (sender)")
-				}
-			}
+			// Transfers in both directions share this connection until 'quit'
+			d := connections.NewMux(conn, true)
+			go serveMux(d, peerName, opts, nil, nil)
+			runSession(d, peerName, opts)
+			fmt.Println("Goodbye.")
+			d.Close()
+			return
 		}
 	}
 
 	// End of program
 }
 
+// Labels of the streams a connection carries (see connections.Mux).
+const (
+	streamTransfer = "transfer"
+	streamChat     = "chat"
+	streamParallel = "parallel" // the only stream of an extra connection of a parallel transfer
+)
+
+// maxChats bounds the chat messages being received at once.
+const maxChats = 4
+
+// Streams served at once, across all peers: receiving is set from --max-peers.
+var (
+	receiving limiter
+	chatting  = newLimiter(maxChats)
+)
+
+// limiter bounds how many streams of one kind are served at once; nil means no limit.
+type limiter chan struct{}
+
+func newLimiter(n int) limiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(limiter, n)
+}
+
+// take claims a slot, or reports false when all are in use.
+func (l limiter) take() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l limiter) put() {
+	if l != nil {
+		<-l
+	}
+}
+
+// sendOnce waits for peer to be discovered, connects with password and sends path; "-" sends
+// standard input as a stream called streamName.
+func sendOnce(nodes <-chan connections.Node, self, peer, password, path, streamName string, opts transfer.Options) error {
+	timeout := time.After(30 * time.Second)
+	for {
+		var n connections.Node
+		select {
+		case node, ok := <-nodes:
+			if !ok {
+				return fmt.Errorf("discovery ended before %s was found", peer)
+			}
+			n = node
+		case <-timeout:
+			return fmt.Errorf("peer %s not found on the local network", peer)
+		}
+		if n.Name != peer {
+			continue
+		}
+		fmt.Printf("Connecting to %s at %s:%d...\n", n.Name, n.IP, n.Port)
+		conn, peerName, err := connections.DialAndHandshake(n.IP, n.Port, self, password, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Connected to %s\n", peerName)
+		opts.OpenStream = func() (net.Conn, error) {
+			return dialStream(n.IP, n.Port, self, password)
+		}
+		st, err := connections.SingleStream(conn, streamTransfer)
+		if err != nil {
+			return err
+		}
+		defer st.Close()
+		if path == "-" {
+			return transfer.SendStream(st, streamName, os.Stdin, opts)
+		}
+		return transfer.Send(st, path, opts)
+	}
+}
+
+// runSession reads commands for the session with peer until 'quit' or until the session
+// ends. Every command runs on a stream of its own, so it does not wait for transfers the
+// peer started.
+func runSession(d *connections.Mux, peer string, opts transfer.Options) {
+	for {
+		fmt.Print("Enter 'send <path>' to transfer a file, 'ls [dir]' or 'get <path>' for the peer's share, 'msg <text>' to chat, 'cancel' to abort running transfers, or 'quit' to exit: ")
+		cmd := strings.TrimSpace(readLine())
+		if cmd == "quit" {
+			return
+		}
+		if err := d.Err(); err != nil {
+			fmt.Printf("Connection to %s ended: %v\n", peer, err)
+			return
+		}
+		if cmd == "cancel" {
+			cancelTransfers(peer)
+			continue
+		}
+		verb, arg, _ := strings.Cut(cmd, " ")
+		arg = strings.TrimSpace(arg)
+		if (verb != "send" && verb != "get" && verb != "ls" && verb != "msg") || (verb != "ls" && arg == "") {
+			continue
+		}
+		label := streamTransfer
+		if verb == "msg" {
+			label = streamChat
+		}
+		st, err := d.Open(label)
+		if err != nil {
+			fmt.Printf("Connection to %s ended: %v\n", peer, err)
+			return
+		}
+		// The terminal stays open for 'cancel' while the command runs
+		ctx, done := running.start(peer)
+		errc := make(chan error, 1)
+		go func() { errc <- runCommand(ctx, st, verb, arg, opts) }()
+		err = awaitCommand(errc, peer)
+		done()
+		st.Close()
+		if err != nil {
+			fmt.Printf("%s failed: %v\n", verb, err)
+		}
+	}
+}
+
+// awaitCommand returns the result of the command running in the background, reading the
+// terminal meanwhile so 'cancel' can abort it.
+func awaitCommand(errc <-chan error, peer string) error {
+	stdinOnce.Do(startStdin)
+	lines, closed := stdinLines, stdinDone
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case l := <-lines:
+			switch strings.TrimSpace(l) {
+			case "cancel":
+				cancelTransfers(peer)
+			case "":
+			default:
+				transfer.Printf("A command is still running; enter 'cancel' to abort it\n")
+			}
+		case <-closed:
+			lines, closed = nil, nil
+		}
+	}
+}
+
+// runCommand runs one session command on its own stream st; ctx ends a send or get.
+func runCommand(ctx context.Context, st net.Conn, verb, arg string, opts transfer.Options) error {
+	switch verb {
+	case "send":
+		if err := transfer.SendContext(ctx, st, arg, opts); err != nil {
+			return err
+		}
+		fmt.Println("File transfer complete (sender); receiver confirmed delivery")
+	case "ls":
+		l, err := transfer.List(st, arg, opts)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("/%s: %d entries\n", l.Path, len(l.Entries))
+		for _, e := range l.Entries {
+			mtime := time.Unix(0, e.ModTime).Format("2006-01-02 15:04")
+			if e.Dir {
+				fmt.Printf("  %-10s  %s  %s/\n", "dir", mtime, e.Name)
+			} else {
+				fmt.Printf("  %10d  %s  %s\n", e.Size, mtime, e.Name)
+			}
+		}
+		if l.Truncated {
+			fmt.Println("  ... (listing truncated)")
+		}
+	case "get":
+		man, path, err := transfer.PullContext(ctx, st, arg, opts)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Pulled %s -> %s\n", man.Name, path)
+	case "msg":
+		if err := transfer.SendMessage(st, arg, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveMux serves every stream the peer opens on d until the connection ends: transfers
+// each on a goroutine of their own, chat messages by printing them. Streams beyond the
+// limits (receiving, chatting) are refused. With done set (--output) transfers are taken one
+// at a time and the first file received, or the end of the connection, is reported to done.
+// A connection that opens with a streamParallel stream carries nothing else and ends with
+// that stream. Once the stream joined a pending parallel transfer, release gives back its
+// listener slot, as such a connection is not another peer; until then it counts as one.
+func serveMux(d *connections.Mux, peer string, opts transfer.Options, done func(error), release func()) {
+	for first := true; ; first = false {
+		st, err := d.Accept()
+		if err != nil {
+			if !errors.Is(err, connections.ErrMuxClosed) && !errors.Is(err, io.EOF) {
+				transfer.Printf("Connection with %s ended: %v\n", peer, err)
+			}
+			if done != nil {
+				done(err)
+			}
+			return
+		}
+		switch {
+		case st.Label() == streamParallel:
+			if !first || release == nil {
+				st.Close()
+				continue
+			}
+			serveJoin(st, peer, opts, release)
+			return
+		case st.Label() == streamChat:
+			if !chatting.take() {
+				st.Close()
+				continue
+			}
+			go func() {
+				defer chatting.put()
+				receiveChat(st, peer, opts)
+			}()
+		case st.Label() != streamTransfer:
+			st.Close()
+		case done == nil:
+			if !receiving.take() {
+				transfer.Printf("Refused a transfer from %s: %d transfers already running (--max-peers)\n", peer, cap(receiving))
+				st.Close()
+				continue
+			}
+			go func() {
+				defer receiving.put()
+				receiveOn(st, peer, opts)
+			}()
+		default:
+			if finished, err := receiveOn(st, peer, opts); finished {
+				done(err)
+				return
+			}
+		}
+	}
+}
+
+// receiveChat prints the message the peer sent on st, under the name its identity was
+// verified with.
+func receiveChat(st net.Conn, peer string, opts transfer.Options) {
+	defer st.Close()
+	from, msg, err := transfer.ReceiveMessage(st, opts)
+	if err != nil {
+		transfer.Printf("\nMessage from %s failed: %v\n", peer, err)
+		return
+	}
+	transfer.Printf("\n[%s] %s\n", from.Name, msg)
+}
+
+// receiveOn runs the transfer the peer started on st and reports it. finished is true once a
+// file or batch was received or failed, and false for declined offers, pull requests and the
+// extra streams of a parallel transfer.
+func receiveOn(st net.Conn, peer string, opts transfer.Options) (finished bool, err error) {
+	defer st.Close()
+	ctx, done := running.start(peer)
+	defer done()
+	man, path, err := transfer.ReceiveContext(ctx, st, opts)
+	switch {
+	case errors.Is(err, transfer.ErrStreamDone):
+		return false, nil
+	case errors.Is(err, transfer.ErrDeclined) || errors.Is(err, transfer.ErrServed):
+		transfer.Printf("%v\n", err)
+		return false, nil
+	case err != nil:
+		transfer.Printf("File receive from %s failed: %v\n", peer, err)
+		return true, err
+	}
+	transfer.Printf("File transfer complete (receiver). Received %s from %s -> %s\n", man.Name, peer, path)
+	return true, nil
+}
+
+// errCanceled is the reason sent to the peer when the user cancels.
+var errCanceled = errors.New("canceled by the user")
+
+// transfers tracks the transfers running with each peer, in either direction, so 'cancel'
+// can abort them.
+type transfers struct {
+	mu   sync.Mutex
+	next int
+	m    map[int]runningTransfer
+}
+
+type runningTransfer struct {
+	peer   string
+	cancel context.CancelCauseFunc
+}
+
+var running = &transfers{m: make(map[int]runningTransfer)}
+
+// start registers a transfer with peer; done must be called once it has ended.
+func (t *transfers) start(peer string) (ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	t.mu.Lock()
+	id := t.next
+	t.next++
+	t.m[id] = runningTransfer{peer: peer, cancel: cancel}
+	t.mu.Unlock()
+	return ctx, func() {
+		t.mu.Lock()
+		delete(t.m, id)
+		t.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// cancel aborts every transfer running with peer, or every transfer at all for "", and
+// reports whether there was one.
+func (t *transfers) cancel(peer string, cause error) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	found := false
+	for _, r := range t.m {
+		if peer == "" || r.peer == peer {
+			r.cancel(cause)
+			found = true
+		}
+	}
+	return found
+}
+
+// cancelTransfers aborts the transfers running with peer at the user's request.
+func cancelTransfers(peer string) {
+	if !running.cancel(peer, errCanceled) {
+		transfer.Printf("No transfer with %s is running\n", peer)
+		return
+	}
+	transfer.Printf("Canceling the transfers with %s...\n", peer)
+}
+
+// cancelAllTransfers aborts every running transfer at the user's request, e.g. the ones
+// peers started on a node that only receives, and reports whether there was one.
+func cancelAllTransfers() bool {
+	if !running.cancel("", errCanceled) {
+		transfer.Printf("No transfer is running\n")
+		return false
+	}
+	transfer.Printf("Canceling all transfers...\n")
+	return true
+}
+
+// cancelOnInterrupt makes Ctrl-C cancel the running transfers in --output mode, which has no
+// prompt to type 'cancel' at. With none running it calls idle instead; a second Ctrl-C ends
+// the program at once.
+func cancelOnInterrupt(idle func()) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		signal.Stop(interrupt)
+		if !cancelAllTransfers() {
+			idle()
+		}
+	}()
+}
+
+// dialStream opens another authenticated connection to a peer for an extra stream of a
+// parallel transfer.
+func dialStream(ip string, port int, self, password string) (net.Conn, error) {
+	c, _, err := connections.DialAndHandshake(ip, port, self, password, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return connections.SingleStream(c, streamParallel)
+}
+
+// acceptStreamsAfterSAS wraps opts.ConfirmSAS so that the extra data channels of peer are
+// served once the user confirmed the code of a session on the primary channel, and not before.
+func acceptStreamsAfterSAS(peer *connections.Peer, opts *transfer.Options) {
+	confirm, streamOpts := opts.ConfirmSAS, *opts
+	var once sync.Once
+	opts.ConfirmSAS = func(p transfer.PeerIdentity, code string) bool {
+		ok := confirm(p, code)
+		if ok {
+			once.Do(func() { go acceptStreams(peer, streamOpts) })
+		}
+		return ok
+	}
+}
+
+// acceptStreams serves the extra data channels a WebRTC sender opens for parallel transfers.
+// The peer can open one whether or not it passed the SAS comparison, so they only carry
+// streams joining a transfer whose control session passed it (no second SAS is asked for),
+// and nothing else.
+func acceptStreams(peer *connections.Peer, opts transfer.Options) {
+	opts.ConfirmSAS = nil
+	for {
+		conn, err := peer.AcceptStream()
+		if err != nil {
+			return
+		}
+		go serveJoin(conn, "WebRTC peer", opts, nil)
+	}
+}
+
+// serveJoin receives the range of a parallel transfer an extra connection carries. It takes
+// nothing but a join to a transfer running on a verified connection; joined, if set, is called
+// once the join was accepted, so the connection stops counting as a peer only then.
+func serveJoin(conn net.Conn, peer string, opts transfer.Options, joined func()) {
+	defer conn.Close()
+	opts.JoinsOnly = true
+	opts.OnJoin = joined
+	_, _, err := transfer.Receive(conn, opts)
+	if err != nil && !errors.Is(err, transfer.ErrStreamDone) {
+		transfer.Printf("Parallel stream from %s ended: %v\n", peer, err)
+	}
+}
+
+// joinSignaling exchanges SDP (and, with trickle, ICE candidates) through a signaling room
+// instead of copy-paste. The offerer (sender) waits for the other peer to join before offering.
+func joinSignaling(serverURL, room string, ice connections.ICEConfig, offerer, trickle bool) *connections.Peer {
+	sc, err := connections.JoinRoom(serverURL, room)
+	if err != nil {
+		log.Fatalf("Failed to join signaling room: %v", err)
+	}
+	fmt.Printf("Joined signaling room %q on %s, waiting for peer...\n", room, serverURL)
+	var peer *connections.Peer
+	if offerer {
+		peer, err = connections.OfferViaSignaling(sc, ice, trickle)
+	} else {
+		peer, err = connections.AnswerViaSignaling(sc, ice, trickle)
+	}
+	if err != nil {
+		log.Fatalf("Signaling failed: %v", err)
+	}
+	return peer
+}
+
+// iceConfig builds the WebRTC ICE settings from an optional JSON file, then STUN/TURN lists.
+// Each flag falls back to its LEARNP2P_* environment variable. Explicit STUN/TURN URLs
+// replace the file's servers; TURN credentials fill any TURN server that has none.
+func iceConfig(path, stun, turn, user, cred string) (connections.ICEConfig, error) {
+	path = flagOrEnv(path, "LEARNP2P_ICE_CONFIG")
+	stun = flagOrEnv(stun, "LEARNP2P_STUN")
+	turn = flagOrEnv(turn, "LEARNP2P_TURN")
+	user = flagOrEnv(user, "LEARNP2P_TURN_USERNAME")
+	cred = flagOrEnv(cred, "LEARNP2P_TURN_CREDENTIAL")
+
+	var cfg connections.ICEConfig
+	if path != "" {
+		c, err := connections.LoadICEConfig(path)
+		if err != nil {
+			return cfg, err
+		}
+		cfg = c
+	}
+	if stun != "" || turn != "" {
+		cfg.Servers = []connections.ICEServer{}
+		if stun != "" {
+			cfg.Servers = append(cfg.Servers, connections.ICEServer{URLs: splitList(stun)})
+		}
+		if turn != "" {
+			cfg.Servers = append(cfg.Servers, connections.ICEServer{URLs: splitList(turn)})
+		}
+	}
+	for i, s := range cfg.Servers {
+		if s.Username != "" || s.Credential != "" {
+			continue
+		}
+		for _, u := range s.URLs {
+			if strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:") {
+				cfg.Servers[i].Username, cfg.Servers[i].Credential = user, cred
+				break
+			}
+		}
+	}
+	return cfg, nil
+}
+
+func flagOrEnv(v, env string) string {
+	if v != "" {
+		return v
+	}
+	return os.Getenv(env)
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// confirmSAS returns a prompt that shows the verification code and asks the user to compare
+// it with the peer's screen. Once a peer identity is confirmed on this connection, later
+// sessions signed by the same identity key are accepted without asking again.
+func confirmSAS() func(transfer.PeerIdentity, string) bool {
+	var mu sync.Mutex // transfers in both directions may ask at once; one question at a time
+	confirmed := make(map[string]bool)
+	return func(p transfer.PeerIdentity, code string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if confirmed[p.Fingerprint] {
+			return true
+		}
+		q := fmt.Sprintf("\nVerification code for %s: %s\nDoes the peer show the same code? [y/N]: ", p.Name, code)
+		ans, _ := ask(q, 0)
+		ans = strings.ToLower(strings.TrimSpace(ans))
+		if ans != "y" && ans != "yes" {
+			return false
+		}
+		confirmed[p.Fingerprint] = true
+		return true
+	}
+}
+
+// confirmOffer asks the user whether to accept an incoming transfer. Offers nobody answers
+// within timeout are declined.
+func confirmOffer(timeout time.Duration) func(transfer.IncomingOffer) bool {
+	return func(o transfer.IncomingOffer) bool {
+		q := fmt.Sprintf("\nIncoming: %s\nPeer key: %s\nAccept? [y/N]: ", o.Pretty(), o.Peer.Fingerprint)
+		ans, ok := ask(q, timeout)
+		if !ok {
+			transfer.Printf("\nNo answer for %s; declined.\n", o.Pretty())
+			return false
+		}
+		ans = strings.ToLower(strings.TrimSpace(ans))
+		return ans == "y" || ans == "yes"
+	}
+}
+
+// acceptRules parses the --auto-accept-* flags.
+func acceptRules(from, maxSize, exts string) (transfer.AcceptRules, error) {
+	r := transfer.AcceptRules{TrustedPeers: splitList(from)}
+	for _, e := range splitList(exts) {
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		r.Extensions = append(r.Extensions, e)
+	}
+	if maxSize != "" {
+		n, err := parseSize(maxSize)
+		if err != nil {
+			return r, err
+		}
+		r.MaxSize = n
+	}
+	return r, nil
+}
+
+// parseSize reads a byte count with an optional K, M or G suffix (powers of 1024),
+// e.g. "500K", "20MiB" or "1G".
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	u := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	u = strings.TrimSuffix(u, "I") // KiB, MiB, GiB
+	switch {
+	case strings.HasSuffix(u, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(u, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(u, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		u = u[:len(u)-1]
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(u), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// Standard input is read by one goroutine. Questions raised by background transfers (ask)
+// take the next line ahead of the REPL (readLine), so both can share the terminal.
+var (
+	stdinOnce  sync.Once
+	stdinLines = make(chan string)
+	stdinDone  = make(chan struct{})
+	promptMu   sync.Mutex
+	prompts    []chan string
+)
+
+func startStdin() {
+	go func() {
+		r := bufio.NewReader(os.Stdin)
+		for {
+			s, err := r.ReadString('\n')
+			if s != "" || err == nil {
+				line := strings.TrimRight(s, "\r\n")
+				promptMu.Lock()
+				if len(prompts) > 0 {
+					p := prompts[0]
+					prompts = prompts[1:]
+					promptMu.Unlock()
+					p <- line
+				} else {
+					promptMu.Unlock()
+					stdinLines <- line
+				}
+			}
+			if err != nil {
+				close(stdinDone)
+				return
+			}
+		}
+	}()
+}
+
 func readLine() string {
-	r := bufio.NewReader(os.Stdin)
-	s, _ := r.ReadString('\n')
-	return strings.TrimRight(s, "\r\n")
+	stdinOnce.Do(startStdin)
+	select {
+	case l := <-stdinLines:
+		return l
+	case <-stdinDone:
+		return ""
+	}
+}
+
+// ask prints question and returns the next input line; ok is false on timeout (if > 0)
+// or when standard input is closed.
+func ask(question string, timeout time.Duration) (string, bool) {
+	stdinOnce.Do(startStdin)
+	ch := make(chan string, 1)
+	promptMu.Lock()
+	prompts = append(prompts, ch)
+	promptMu.Unlock()
+	transfer.Printf("%s", question)
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case l := <-ch:
+		return l, true
+	case <-expired:
+	case <-stdinDone:
+	}
+	promptMu.Lock()
+	prompts = slices.DeleteFunc(prompts, func(c chan string) bool { return c == ch })
+	promptMu.Unlock()
+	select {
+	case l := <-ch: // answered while we gave up
+		return l, true
+	default:
+		return "", false
+	}
 }
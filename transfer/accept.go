@@ -0,0 +1,149 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// ErrDeclined is returned on both sides when the receiver declines an offer. The session
+// stays usable: nothing was streamed and the next transfer can follow on the same connection.
+var ErrDeclined = errors.New("transfer declined")
+
+// IncomingOffer is what the receiving user is shown before anything is written.
+type IncomingOffer struct {
+	Peer  PeerIdentity
+	Name  string // file name, or the root directory of a batch
+	Size  int64  // total bytes, or SizeUnknown for a stream
+	Files int    // number of files (1 for a single file)
+	Batch bool
+}
+
+// Pretty returns a one-line description such as "photos/ (12 files, 48.00 MiB) from alice".
+// The names come from the peer, so control characters in them are dropped (see printableText):
+// they could otherwise rewrite the prompt the offer is shown in.
+func (o IncomingOffer) Pretty() string {
+	name, peer := printableText(o.Name), printableText(o.Peer.Name)
+	if o.Size == SizeUnknown {
+		return fmt.Sprintf("%s (streamed, size unknown) from %s", name, peer)
+	}
+	if o.Batch {
+		return fmt.Sprintf("%s/ (%d files, %s) from %s", name, o.Files, humanBytes(o.Size), peer)
+	}
+	return fmt.Sprintf("%s (%s) from %s", name, humanBytes(o.Size), peer)
+}
+
+// AcceptRules auto-accept offers without asking. An offer is accepted when the peer is in
+// TrustedPeers and pinned in known_peers, or when at least one of MaxSize and Extensions is
+// set and the offer passes every rule that is set.
+type AcceptRules struct {
+	TrustedPeers []string // peer node names (as pinned in known_peers; unpinned peers never match)
+	MaxSize      int64    // total size limit in bytes; 0 disables the rule
+	Extensions   []string // allowed extensions such as ".txt"; every file must match; empty disables the rule
+}
+
+// offerReply is the receiver's decision on an offer (AAD="offer-reply").
+// Compression is the chunk codec picked from the offer's list.
+type offerReply struct {
+	Accept      bool   `json:"accept"`
+	Reason      string `json:"reason,omitempty"`
+	Compression string `json:"compression,omitempty"`
+}
+
+func (r *offerReply) printable() { r.Reason = printableText(r.Reason) }
+
+// match reports whether the rules accept the offer o whose file names are names.
+func (r AcceptRules) match(o IncomingOffer, names []string) bool {
+	if o.Peer.Pinned && slices.Contains(r.TrustedPeers, o.Peer.Name) {
+		return true
+	}
+	if r.MaxSize <= 0 && len(r.Extensions) == 0 {
+		return false
+	}
+	if r.MaxSize > 0 && (o.Size > r.MaxSize || o.Size == SizeUnknown) {
+		return false
+	}
+	if len(r.Extensions) > 0 {
+		for _, n := range names {
+			if !slices.ContainsFunc(r.Extensions, func(ext string) bool {
+				return strings.EqualFold(path.Ext(n), ext)
+			}) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// decideOffer applies the auto-accept rules, then asks opts.ConfirmOffer, and sends the
+// decision to the sender. Without ConfirmOffer every offer is accepted.
+func (s *session) decideOffer(opts Options, o offer) error {
+	in := IncomingOffer{Peer: s.peer}
+	var names []string
+	if o.Batch != nil {
+		in.Name, in.Size, in.Files, in.Batch = o.Batch.Root, o.Batch.Size, len(o.Batch.Files), true
+		for _, m := range o.Batch.Files {
+			names = append(names, m.Name)
+		}
+	} else if o.File != nil {
+		in.Name, in.Size, in.Files = o.File.Name, o.File.Size, 1
+		names = []string{o.File.Name}
+	}
+
+	reply := offerReply{Accept: true, Compression: opts.pickCompression(o.Compression)}
+	switch {
+	case in.Batch && opts.Output != nil:
+		reply = offerReply{Reason: "receiver only accepts single files"}
+	case opts.AutoAccept.match(in, names):
+		Printf("Auto-accepting %s\n", in.Pretty())
+	case opts.ConfirmOffer != nil && !opts.ConfirmOffer(in):
+		reply = offerReply{Reason: "declined by the receiving user"}
+	}
+	if err := s.writeJSON(reply, "offer-reply"); err != nil {
+		return fmt.Errorf("write offer reply: %w", err)
+	}
+	if err := s.flush(); err != nil {
+		// The sender may have given up while the user was deciding
+		return s.pendingAbort(fmt.Errorf("flush offer reply: %w", err))
+	}
+	if !reply.Accept {
+		return fmt.Errorf("%w: %s", ErrDeclined, in.Pretty())
+	}
+	codec, err := newChunkCodec(reply.Compression)
+	if err != nil {
+		return err
+	}
+	s.codec = codec
+	return nil
+}
+
+// refuseOffer declines o without asking anyone, e.g. on a connection that does not take
+// offers of its kind.
+func (s *session) refuseOffer(o offer, reason string) error {
+	if err := s.writeJSON(offerReply{Reason: reason}, "offer-reply"); err != nil {
+		return fmt.Errorf("write offer reply: %w", err)
+	}
+	if err := s.flush(); err != nil {
+		return fmt.Errorf("flush offer reply: %w", err)
+	}
+	return fmt.Errorf("%w: %s offer from %s: %s", ErrDeclined, o.Type, s.peer.Name, reason)
+}
+
+// awaitAcceptance reads the receiver's decision after the manifest has been sent.
+func (s *session) awaitAcceptance() error {
+	var reply offerReply
+	if err := s.readJSON(&reply, "offer-reply"); err != nil {
+		return fmt.Errorf("read offer reply: %w", err)
+	}
+	if !reply.Accept {
+		return fmt.Errorf("%w by %s: %s", ErrDeclined, s.peer.Name, reply.Reason)
+	}
+	codec, err := newChunkCodec(reply.Compression)
+	if err != nil {
+		return err
+	}
+	s.codec = codec
+	return nil
+}
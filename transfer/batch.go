@@ -0,0 +1,179 @@
+package transfer
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// BatchManifest describes a directory tree sent under one session key.
+// Paths are slash-separated and relative to Root.
+type BatchManifest struct {
+	Root   string        `json:"root"`
+	Size   int64         `json:"size"`             // total bytes across Files
+	Dirs   []string      `json:"dirs"`             // every directory below Root, parents first
+	Files  []Manifest    `json:"files"`            // Name holds the relative path
+	Failed []FileFailure `json:"failed,omitempty"` // entries the sender could not include
+	// Symlinks and HardLinks are created once every file has been received (see links.go).
+	Symlinks  []Link `json:"symlinks,omitempty"`
+	HardLinks []Link `json:"hardlinks,omitempty"`
+}
+
+// FileFailure records why a single entry of a batch was not transferred.
+type FileFailure struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// BatchSummary is sent by the receiver once every file of a batch has been handled.
+type BatchSummary struct {
+	Root      string        `json:"root"`
+	Received  []string      `json:"received"`
+	Bytes     int64         `json:"bytes"`
+	EmptyDirs []string      `json:"emptyDirs"`
+	Links     []string      `json:"links,omitempty"` // symlinks and hard links created
+	Failed    []FileFailure `json:"failed"`
+}
+
+// fileError marks a failure confined to one file; the session stays in sync and
+// a batch continues with its next entry.
+type fileError struct{ err error }
+
+func (e *fileError) Error() string { return e.err.Error() }
+func (e *fileError) Unwrap() error { return e.err }
+
+// BuildBatchManifest walks root and hashes every regular file below it. Symlinks are listed
+// as links; one whose target lies outside root is handled by escaping. Further names of a
+// file already listed become hard links.
+// Entries that cannot be read or are not regular files are listed in Failed rather than aborting.
+func BuildBatchManifest(root string, escaping LinkPolicy) (BatchManifest, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return BatchManifest{}, err
+	}
+	b := BatchManifest{Root: filepath.Base(abs), Dirs: []string{}, Files: []Manifest{}}
+	addFile := func(p, rel string) bool {
+		m, merr := BuildManifest(p)
+		if merr != nil {
+			b.Failed = append(b.Failed, FileFailure{Path: rel, Reason: merr.Error()})
+			return false
+		}
+		m.Name = rel
+		b.Files = append(b.Files, m)
+		b.Size += m.Size
+		return true
+	}
+	firstName := make(map[inode]string) // batch path each multiply linked file is sent under
+	err = filepath.WalkDir(abs, func(p string, d fs.DirEntry, werr error) error {
+		rel, rerr := filepath.Rel(abs, p)
+		if rerr != nil {
+			return rerr
+		}
+		rel = filepath.ToSlash(rel)
+		if werr != nil {
+			if rel == "." {
+				return werr
+			}
+			b.Failed = append(b.Failed, FileFailure{Path: rel, Reason: werr.Error()})
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch {
+		case rel == ".":
+			return nil
+		case d.IsDir():
+			b.Dirs = append(b.Dirs, rel)
+		case d.Type().IsRegular():
+			fi, ierr := d.Info()
+			if ierr != nil {
+				b.Failed = append(b.Failed, FileFailure{Path: rel, Reason: ierr.Error()})
+				return nil
+			}
+			id, links, ok := fileID(fi)
+			if ok && links > 1 {
+				if first, dup := firstName[id]; dup {
+					b.HardLinks = append(b.HardLinks, Link{Name: rel, Target: first})
+					return nil
+				}
+			}
+			if addFile(p, rel) && ok && links > 1 {
+				firstName[id] = rel
+			}
+		case d.Type()&fs.ModeSymlink != 0:
+			target, lerr := os.Readlink(p)
+			if lerr != nil {
+				b.Failed = append(b.Failed, FileFailure{Path: rel, Reason: lerr.Error()})
+				return nil
+			}
+			target = filepath.ToSlash(target)
+			switch {
+			case linkInside(rel, target) || escaping == LinkKeep:
+				b.Symlinks = append(b.Symlinks, Link{Name: rel, Target: target})
+			case escaping == LinkFollow:
+				if fi, serr := os.Stat(p); serr != nil || !fi.Mode().IsRegular() {
+					b.Failed = append(b.Failed, FileFailure{Path: rel, Reason: "symlink outside the root does not lead to a regular file"})
+					return nil
+				}
+				addFile(p, rel)
+			default:
+				b.Failed = append(b.Failed, FileFailure{Path: rel, Reason: "symlink leaves the root: " + target})
+			}
+		default:
+			b.Failed = append(b.Failed, FileFailure{Path: rel, Reason: "not a regular file"})
+		}
+		return nil
+	})
+	if err != nil {
+		return BatchManifest{}, err
+	}
+	return b, nil
+}
+
+// emptyDirs returns the directories in b that contain no files and no subdirectories.
+func (b BatchManifest) emptyDirs() []string {
+	used := make(map[string]bool)
+	mark := func(p string) {
+		for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			used[dir] = true
+		}
+	}
+	for _, f := range b.Files {
+		mark(f.Name)
+	}
+	for _, d := range b.Dirs {
+		mark(d)
+	}
+	for _, l := range slices.Concat(b.Symlinks, b.HardLinks) {
+		mark(l.Name)
+	}
+	var out []string
+	for _, d := range b.Dirs {
+		if !used[d] {
+			out = append(out, d)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Pretty returns a human readable multi-line report of the batch outcome. Paths and reasons
+// may come from the peer, so control characters in them are dropped (see printableText).
+func (s BatchSummary) Pretty() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Batch %s: %d file(s) received (%s), %d link(s), %d failed, %d empty dir(s)",
+		printableText(s.Root), len(s.Received), humanBytes(s.Bytes), len(s.Links), len(s.Failed), len(s.EmptyDirs))
+	for _, d := range s.EmptyDirs {
+		fmt.Fprintf(&sb, "\n  empty dir: %s", printableText(d))
+	}
+	for _, f := range s.Failed {
+		fmt.Fprintf(&sb, "\n  FAILED %s: %s", printableText(f.Path), printableText(f.Reason))
+	}
+	return sb.String()
+}
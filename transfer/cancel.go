@@ -0,0 +1,229 @@
+package transfer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Cancellation. A transfer run with a context (SendContext, ReceiveContext, ...) ends once the
+// context is done, on either side:
+//
+//	canceling side -> abort {reason} (AAD="abort"), sealed with the next nonce of its direction
+//	                  in place of whatever it would have sent next; then it closes the connection
+//
+// Closing the connection also releases anything the transfer was blocked on. The other side
+// finds the abort wherever it next reads a frame: one that does not open with the expected AAD
+// is tried as an abort. A side whose write fails first, like a sender busy streaming or a
+// receiver sending a receipt, reads the abort after that. Both sides return ErrAborted.
+// The .part of the file being received is kept for a later resume, or removed with
+// PartialDelete; it is not renamed into place once the transfer was canceled.
+
+// ErrAborted is returned when either side canceled the transfer. The error says which side
+// and why.
+var ErrAborted = errors.New("transfer aborted")
+
+// errAbortSent fails writes after an abort went out.
+var errAbortSent = errors.New("abort sent")
+
+var abortAAD = []byte("abort")
+
+// abortWait bounds how long the abort waits for a frame being written. A write that takes
+// longer is stuck because the peer stopped reading, so the abort could not get through anyway.
+const abortWait = 2 * time.Second
+
+// abortMsg tells the peer why the transfer was canceled.
+type abortMsg struct {
+	Reason string `json:"reason"`
+}
+
+// PartialPolicy decides what the receiver does with the partial data of a file whose
+// transfer was aborted by either side.
+type PartialPolicy string
+
+const (
+	PartialKeep   PartialPolicy = "keep"   // leave the .part, so sending the file again resumes it
+	PartialDelete PartialPolicy = "delete" // remove the .part
+)
+
+// ParsePartialPolicy validates a policy name; "" selects PartialKeep.
+func ParsePartialPolicy(s string) (PartialPolicy, error) {
+	switch p := PartialPolicy(s); p {
+	case "":
+		return PartialKeep, nil
+	case PartialKeep, PartialDelete:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown partial data policy %q (want keep or delete)", s)
+	}
+}
+
+// SendContext is Send, aborted once ctx is done.
+func SendContext(ctx context.Context, conn net.Conn, filePath string, opts Options) error {
+	c := watchContext(ctx, conn, &opts)
+	defer c.stop()
+	return c.result(Send(conn, filePath, opts))
+}
+
+// SendStreamContext is SendStream, aborted once ctx is done. A read from r is not interrupted:
+// the peer learns of the abort at once, but SendStreamContext returns only once r yields.
+func SendStreamContext(ctx context.Context, conn net.Conn, name string, r io.Reader, opts Options) error {
+	c := watchContext(ctx, conn, &opts)
+	defer c.stop()
+	return c.result(SendStream(conn, name, r, opts))
+}
+
+// ReceiveContext is Receive, aborted once ctx is done.
+func ReceiveContext(ctx context.Context, conn net.Conn, opts Options) (Manifest, string, error) {
+	c := watchContext(ctx, conn, &opts)
+	defer c.stop()
+	man, p, err := Receive(conn, opts)
+	return man, p, c.result(err)
+}
+
+// PullContext is Pull, aborted once ctx is done.
+func PullContext(ctx context.Context, conn net.Conn, remotePath string, opts Options) (Manifest, string, error) {
+	c := watchContext(ctx, conn, &opts)
+	defer c.stop()
+	man, p, err := Pull(conn, remotePath, opts)
+	return man, p, c.result(err)
+}
+
+// canceler ends the transfer on conn once its context is done. It travels in Options, so
+// every session the transfer opens registers with it.
+type canceler struct {
+	ctx  context.Context
+	stop func() bool
+
+	mu    sync.Mutex
+	fired bool
+	s     *session   // the session on conn, which carries the abort
+	conns []net.Conn // conn and the extra connections of a parallel transfer
+}
+
+// watchContext ties the transfer on conn to ctx and records it in opts.
+func watchContext(ctx context.Context, conn net.Conn, opts *Options) *canceler {
+	c := &canceler{ctx: ctx, conns: []net.Conn{conn}}
+	opts.cancel = c
+	c.stop = context.AfterFunc(ctx, c.fire)
+	return c
+}
+
+// attach registers a session opened on conn; a transfer that was canceled meanwhile closes it.
+func (c *canceler) attach(s *session, conn net.Conn) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fired {
+		conn.Close()
+		return
+	}
+	if conn == c.conns[0] && c.s == nil {
+		c.s = s
+	} else if !slices.Contains(c.conns, conn) {
+		c.conns = append(c.conns, conn)
+	}
+}
+
+// fire sends the abort, if a session is open, and closes every connection of the transfer.
+func (c *canceler) fire() {
+	c.mu.Lock()
+	c.fired = true
+	s, conns := c.s, c.conns
+	c.mu.Unlock()
+	if s != nil {
+		sent := make(chan struct{})
+		go func() {
+			s.abort(context.Cause(c.ctx).Error())
+			close(sent)
+		}()
+		select {
+		case <-sent:
+		case <-time.After(abortWait):
+			// Closing the connections below releases the stuck write
+		}
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// canceled reports whether the transfer ends because its context is done.
+func (c *canceler) canceled() bool {
+	return c != nil && c.ctx.Err() != nil
+}
+
+// result reports the error of a transfer that was canceled as ErrAborted with the cause.
+func (c *canceler) result(err error) error {
+	if err == nil || !c.canceled() || errors.Is(err, ErrAborted) {
+		return err
+	}
+	return c.err()
+}
+
+// err is ErrAborted with the cause of the cancellation.
+func (c *canceler) err() error {
+	return fmt.Errorf("%w: %w", ErrAborted, context.Cause(c.ctx))
+}
+
+// abort sends the abort frame once no other frame is being written; nothing is written after it.
+func (s *session) abort(reason string) {
+	b, err := json.Marshal(abortMsg{Reason: reason})
+	if err != nil {
+		return
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.aborted {
+		return
+	}
+	s.aborted = true
+	if err := writeSealed(s.bw, s.aead, s.tx.next(), b, abortAAD); err == nil {
+		_ = s.bw.Flush()
+	}
+}
+
+// peerAborted turns the peer's abort frame into ErrAborted.
+func (s *session) peerAborted(b []byte) error {
+	var m abortMsg
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("%w by %s", ErrAborted, s.peer.Name)
+	}
+	return fmt.Errorf("%w by %s: %s", ErrAborted, s.peer.Name, printableText(m.Reason))
+}
+
+// pendingAbort looks for an abort after a write to the peer failed with err: a receiver that
+// cancels closes the connection while we are still streaming, right after its abort.
+// Without one, err is returned.
+func (s *session) pendingAbort(err error) error {
+	if b, rerr := s.readFrame(abortAAD); rerr == nil {
+		return s.peerAborted(b)
+	}
+	return err
+}
+
+// dropPartial removes tmpPath, the .part of a file whose transfer ended with err, when the
+// transfer was aborted and the policy says so.
+func (o Options) dropPartial(tmpPath string, err error) {
+	if o.partialPolicy() == PartialDelete && (errors.Is(err, ErrAborted) || o.cancel.canceled()) {
+		if os.Remove(tmpPath) == nil {
+			Printf("Removed the partial data of %s\n", tmpPath)
+		}
+	}
+}
+
+// writeFailure marks an error writing to the peer. The connection is gone by then, so reading
+// what the peer sent last cannot block.
+type writeFailure struct{ err error }
+
+func (e *writeFailure) Error() string { return e.err.Error() }
+func (e *writeFailure) Unwrap() error { return e.err }
@@ -0,0 +1,134 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Chunk compression names, negotiated per transfer: the sender lists what it can use in the
+// offer and the receiver picks one in its offer reply.
+const (
+	CompressNone    = "none"
+	CompressDeflate = "deflate"
+)
+
+// With a codec other than none, every chunk plaintext starts with a flag byte. Chunks that
+// do not shrink are sent raw, so already-compressed data costs one byte per chunk.
+const (
+	chunkRaw     byte = 0
+	chunkDeflate byte = 1
+)
+
+// ParseCompression validates a compression name; "" selects CompressDeflate.
+func ParseCompression(s string) (string, error) {
+	switch s {
+	case "":
+		return CompressDeflate, nil
+	case CompressNone, CompressDeflate:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown compression %q (want deflate or none)", s)
+	}
+}
+
+// compressionOffer lists the codecs the sender offers, in preference order.
+func (o Options) compressionOffer() []string {
+	if o.Compression == CompressNone {
+		return []string{CompressNone}
+	}
+	return []string{CompressDeflate, CompressNone}
+}
+
+// pickCompression chooses the receiver's codec from the sender's offer.
+func (o Options) pickCompression(offered []string) string {
+	if o.Compression != CompressNone && slices.Contains(offered, CompressDeflate) {
+		return CompressDeflate
+	}
+	return CompressNone
+}
+
+// chunkCodec compresses chunk plaintexts before sealing and restores them after opening.
+// The manifest hash always covers the original bytes.
+type chunkCodec struct {
+	name string
+	buf  bytes.Buffer
+	w    *flate.Writer
+	r    io.ReadCloser
+}
+
+func newChunkCodec(name string) (*chunkCodec, error) {
+	switch name {
+	case "", CompressNone:
+		return &chunkCodec{name: CompressNone}, nil
+	case CompressDeflate:
+		return &chunkCodec{name: name}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", name)
+	}
+}
+
+// encode returns the plaintext to seal for chunk. The result is only valid until the next call.
+func (c *chunkCodec) encode(chunk []byte) ([]byte, error) {
+	if c.name == CompressNone {
+		return chunk, nil
+	}
+	c.buf.Reset()
+	c.buf.WriteByte(chunkDeflate)
+	if c.w == nil {
+		w, err := flate.NewWriter(&c.buf, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		c.w = w
+	} else {
+		c.w.Reset(&c.buf)
+	}
+	if _, err := c.w.Write(chunk); err != nil {
+		return nil, err
+	}
+	if err := c.w.Close(); err != nil {
+		return nil, err
+	}
+	if c.buf.Len() < 1+len(chunk) {
+		return c.buf.Bytes(), nil
+	}
+	// Did not shrink: send as is
+	c.buf.Reset()
+	c.buf.WriteByte(chunkRaw)
+	c.buf.Write(chunk)
+	return c.buf.Bytes(), nil
+}
+
+// decode restores a chunk, refusing anything that inflates beyond ChunkSize.
+func (c *chunkCodec) decode(pt []byte) ([]byte, error) {
+	if c.name == CompressNone {
+		return pt, nil
+	}
+	if len(pt) == 0 {
+		return nil, fmt.Errorf("empty chunk")
+	}
+	switch pt[0] {
+	case chunkRaw:
+		return pt[1:], nil
+	case chunkDeflate:
+	default:
+		return nil, fmt.Errorf("unknown chunk encoding %d", pt[0])
+	}
+	src := bytes.NewReader(pt[1:])
+	if c.r == nil {
+		c.r = flate.NewReader(src)
+	} else if err := c.r.(flate.Resetter).Reset(src, nil); err != nil {
+		return nil, err
+	}
+	out, err := io.ReadAll(io.LimitReader(c.r, ChunkSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("inflate chunk: %w", err)
+	}
+	if len(out) > ChunkSize {
+		return nil, fmt.Errorf("inflated chunk exceeds %d bytes", ChunkSize)
+	}
+	return out, nil
+}
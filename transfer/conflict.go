@@ -0,0 +1,105 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ConflictPolicy decides what the receiver does when a file of the same name already exists.
+// It is applied before any data is streamed and the outcome is reported to the sender.
+type ConflictPolicy string
+
+const (
+	ConflictRename        ConflictPolicy = "rename"         // store as "name (1).ext", "name (2).ext", ...
+	ConflictOverwrite     ConflictPolicy = "overwrite"      // replace the existing file once the new one verifies
+	ConflictSkipIdentical ConflictPolicy = "skip-identical" // skip if the SHA-256 matches, otherwise rename
+	ConflictReject        ConflictPolicy = "reject"         // refuse the file
+)
+
+// ErrFileExists is reported when the reject policy refuses a file whose name is taken.
+var ErrFileExists = errors.New("file already exists")
+
+// ParseConflictPolicy validates a policy name; "" selects ConflictRename.
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(s); p {
+	case "":
+		return ConflictRename, nil
+	case ConflictRename, ConflictOverwrite, ConflictSkipIdentical, ConflictReject:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown conflict policy %q (want rename, overwrite, skip-identical or reject)", s)
+	}
+}
+
+// Outcomes reported in resumeRequest.Conflict.
+const (
+	conflictRenamed     = "renamed"
+	conflictOverwritten = "overwritten"
+	conflictIdentical   = "identical"
+)
+
+// placeFile applies policy to outPath and returns the path the file will be stored at and
+// the conflict outcome ("" when the name was free). Unless the outcome is identical, the
+// returned path's .part is claimed and the caller must release it.
+func placeFile(outPath string, man Manifest, policy ConflictPolicy) (string, string, error) {
+	fi, err := os.Lstat(outPath)
+	if errors.Is(err, os.ErrNotExist) {
+		if !claimPath(outPath + ".part") {
+			return "", "", fmt.Errorf("%s is already being received from another peer", man.Name)
+		}
+		return outPath, "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", "", fmt.Errorf("%w: %s is not a regular file", ErrFileExists, filepath.Base(outPath))
+	}
+
+	switch policy {
+	case ConflictOverwrite:
+		if !claimPath(outPath + ".part") {
+			return "", "", fmt.Errorf("%s is already being received from another peer", man.Name)
+		}
+		return outPath, conflictOverwritten, nil
+	case ConflictReject:
+		return "", "", fmt.Errorf("%w: %s", ErrFileExists, filepath.Base(outPath))
+	case ConflictSkipIdentical:
+		if fi.Size() == man.Size && fileHash(outPath) == man.Hash {
+			return outPath, conflictIdentical, nil
+		}
+	}
+	// Rename: first free numbered name that no other running receive has claimed
+	ext := filepath.Ext(outPath)
+	stem := strings.TrimSuffix(outPath, ext)
+	for i := 1; i < 10000; i++ {
+		cand := fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		if _, err := os.Lstat(cand); !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if claimPath(cand + ".part") {
+			return cand, conflictRenamed, nil
+		}
+	}
+	return "", "", fmt.Errorf("%w: no free name for %s", ErrFileExists, filepath.Base(outPath))
+}
+
+// fileHash returns the hex SHA-256 of the file at path, or "" if it cannot be read.
+func fileHash(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
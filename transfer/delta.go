@@ -0,0 +1,299 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Delta synchronization. When the receiver already holds an older version of a file under
+// the same name, it can describe that copy instead of asking for every chunk:
+//
+//	receiver -> resume request {need: the whole file, delta: {blockSize, size, sums}}
+//	            sums holds, per full block of its copy, a rolling checksum and a strong hash
+//	sender   scans its file with the rolling checksum and looks every window up in sums
+//	sender   -> resume reply {delta: {copies}}: which byte ranges of the receiver's copy
+//	            reappear where in the new file
+//	sender   -> the rest of the file (everything no copy covers) as frames of at most
+//	            ChunkSize bytes, in order
+//
+// The receiver assembles the .part from its copy and the streamed bytes, and the manifest
+// SHA-256 check decides as usual. A sender that finds nothing to reuse answers without delta
+// and streams the needed chunks normally.
+
+// deltaStrongSize is how much of each block's SHA-256 the signature carries. A collision
+// only costs a retry: the assembled file still has to match the manifest hash.
+const deltaStrongSize = 16
+
+// deltaSumSize is the size of one block's entry in deltaSignature.Sums.
+const deltaSumSize = 4 + deltaStrongSize
+
+// maxDeltaBlocks bounds the signature so it fits in one frame; larger copies use larger blocks.
+// maxDeltaBlockSize bounds the window the sender has to hold.
+const (
+	maxDeltaBlocks    = 1 << 20
+	maxDeltaBlockSize = 64 << 20
+)
+
+// deltaSignature describes the receiver's existing copy of a file.
+type deltaSignature struct {
+	BlockSize int64 `json:"blockSize"`
+	Size      int64 `json:"size"` // size of the receiver's copy
+	// Sums is weak(4, big-endian) || strong(deltaStrongSize) for every full block of the
+	// copy, in order. A shorter tail block is not described.
+	Sums []byte `json:"sums"`
+}
+
+// deltaPlan is the sender's answer to a signature.
+type deltaPlan struct {
+	Copies []deltaCopy `json:"copies"`
+}
+
+// deltaCopy places Length bytes read at From in the receiver's copy at To in the new file.
+type deltaCopy struct {
+	From   int64 `json:"from"`
+	To     int64 `json:"to"`
+	Length int64 `json:"length"`
+}
+
+// deltaBlockSize picks the signature block size for a copy of size bytes: about the square
+// root of the size, between 2 KiB and 128 KiB, and large enough to stay under maxDeltaBlocks.
+func deltaBlockSize(size int64) int64 {
+	bs := int64(2 << 10)
+	for bs < 128<<10 && bs*bs < size {
+		bs <<= 1
+	}
+	if n := (size + maxDeltaBlocks - 1) / maxDeltaBlocks; n > bs {
+		bs = n
+	}
+	return bs
+}
+
+// deltaSignatureOf reads the file at path and returns its block signature, or nil when it
+// has no full block to offer.
+func deltaSignatureOf(path string) (*deltaSignature, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !st.Mode().IsRegular() {
+		return nil, errors.New("not a regular file")
+	}
+	sig := &deltaSignature{BlockSize: deltaBlockSize(st.Size()), Size: st.Size()}
+	blocks := sig.Size / sig.BlockSize
+	if blocks == 0 {
+		return nil, nil
+	}
+	sig.Sums = make([]byte, 0, blocks*deltaSumSize)
+	r := bufio.NewReaderSize(f, ChunkSize)
+	buf := make([]byte, sig.BlockSize)
+	for i := int64(0); i < blocks; i++ {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		sig.Sums = binary.BigEndian.AppendUint32(sig.Sums, newRollingSum(buf).sum())
+		strong := sha256.Sum256(buf)
+		sig.Sums = append(sig.Sums, strong[:deltaStrongSize]...)
+	}
+	return sig, nil
+}
+
+// valid checks the signature's shape.
+func (sig *deltaSignature) valid() bool {
+	return sig.BlockSize > 0 && sig.BlockSize <= maxDeltaBlockSize && sig.Size >= 0 && sig.Size/sig.BlockSize <= maxDeltaBlocks &&
+		int64(len(sig.Sums)) == sig.Size/sig.BlockSize*deltaSumSize
+}
+
+// rollingSum is the rsync weak checksum over a window: a is the sum of the bytes and b the
+// sum of the running values of a, both mod 2^16, so the window can slide one byte at a time.
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingSum(window []byte) rollingSum {
+	r := rollingSum{n: uint32(len(window))}
+	for i, c := range window {
+		r.a += uint32(c)
+		r.b += uint32(len(window)-i) * uint32(c)
+	}
+	return r
+}
+
+// roll drops out from the front of the window and appends in.
+func (r *rollingSum) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r rollingSum) sum() uint32 { return r.a&0xffff | r.b<<16 }
+
+// computeDelta scans the size bytes of f for blocks described by sig and returns where they
+// reappear, merging neighbouring blocks into one copy. Matches do not overlap.
+func computeDelta(f io.ReaderAt, size int64, sig *deltaSignature) ([]deltaCopy, error) {
+	bs := sig.BlockSize
+	if bs > size {
+		return nil, nil
+	}
+	index := make(map[uint32][]int64)
+	for i := int64(0); i < int64(len(sig.Sums))/deltaSumSize; i++ {
+		weak := binary.BigEndian.Uint32(sig.Sums[i*deltaSumSize:])
+		index[weak] = append(index[weak], i)
+	}
+
+	r := bufio.NewReaderSize(io.NewSectionReader(f, 0, size), ChunkSize)
+	ring := make([]byte, bs)
+	window := make([]byte, bs)
+	var copies []deltaCopy
+	// fill reads a fresh window at pos; false means fewer than bs bytes are left.
+	fill := func() (bool, error) {
+		_, err := io.ReadFull(r, ring)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	ok, err := fill()
+	if !ok {
+		return nil, err
+	}
+	roll := newRollingSum(ring)
+	var pos int64 // file offset of the window
+	head := 0     // ring index of the window's first byte
+	for {
+		if blocks, found := index[roll.sum()]; found {
+			copy(window, ring[head:])
+			copy(window[len(ring)-head:], ring[:head])
+			strong := sha256.Sum256(window)
+			if i, hit := matchBlock(sig, blocks, strong[:deltaStrongSize]); hit {
+				from := i * bs
+				if n := len(copies); n > 0 && copies[n-1].To+copies[n-1].Length == pos && copies[n-1].From+copies[n-1].Length == from {
+					copies[n-1].Length += bs
+				} else {
+					copies = append(copies, deltaCopy{From: from, To: pos, Length: bs})
+				}
+				pos += bs
+				if ok, err := fill(); !ok {
+					return copies, err
+				}
+				roll, head = newRollingSum(ring), 0
+				continue
+			}
+		}
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			return copies, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		roll.roll(ring[head], c)
+		ring[head] = c
+		head = (head + 1) % len(ring)
+		pos++
+	}
+}
+
+// matchBlock returns the first of blocks whose strong hash is strong.
+func matchBlock(sig *deltaSignature, blocks []int64, strong []byte) (int64, bool) {
+	for _, i := range blocks {
+		off := i*deltaSumSize + 4
+		if bytes.Equal(sig.Sums[off:off+deltaStrongSize], strong) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// validDelta checks that copies are ordered, disjoint, inside the new file and read only
+// from the receiver's copy of baseSize bytes. Bounds are compared without adding offsets to
+// lengths, which the peer could make overflow.
+func validDelta(copies []deltaCopy, size, baseSize int64) bool {
+	var next int64
+	for _, c := range copies {
+		if c.Length <= 0 || c.To < next || c.To > size || c.Length > size-c.To ||
+			c.From < 0 || c.From > baseSize || c.Length > baseSize-c.From {
+			return false
+		}
+		next = c.To + c.Length
+	}
+	return true
+}
+
+// deltaLiterals returns the parts of a size-byte file that copies do not cover.
+func deltaLiterals(copies []deltaCopy, size int64) []byteRange {
+	var out []byteRange
+	var next int64
+	for _, c := range copies {
+		if c.To > next {
+			out = append(out, byteRange{Offset: next, Length: c.To - next})
+		}
+		next = c.To + c.Length
+	}
+	if next < size {
+		out = append(out, byteRange{Offset: next, Length: size - next})
+	}
+	return out
+}
+
+// applyCopies copies the planned ranges of the file at basePath into out.
+func applyCopies(out *os.File, basePath string, copies []deltaCopy) error {
+	base, err := os.Open(basePath)
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+	buf := make([]byte, ChunkSize)
+	for _, c := range copies {
+		for done := int64(0); done < c.Length; {
+			n := min(ChunkSize, c.Length-done)
+			if _, err := base.ReadAt(buf[:n], c.From+done); err != nil {
+				return fmt.Errorf("read existing copy: %w", err)
+			}
+			if _, err := out.WriteAt(buf[:n], c.To+done); err != nil {
+				return err
+			}
+			done += n
+		}
+	}
+	return nil
+}
+
+// receiveLiterals reads the streamed parts of a delta transfer and writes them into out at
+// their offsets. Each frame holds the next min(ChunkSize, rest of the range) bytes. Like
+// receiveChunks it drains the stream after a local write error and returns that as werr.
+func receiveLiterals(s *session, out *os.File, ranges []byteRange, aad []byte, onChunk func(int64) error) (werr, err error) {
+	for _, r := range ranges {
+		for off := r.Offset; off < r.Offset+r.Length; {
+			body, err := s.readFrame(aad)
+			if err != nil {
+				return werr, fmt.Errorf("read chunk: %w", err)
+			}
+			pt, err := s.codec.decode(body)
+			if err != nil {
+				return werr, fmt.Errorf("read chunk: %w", err)
+			}
+			if int64(len(pt)) != min(ChunkSize, r.Offset+r.Length-off) {
+				return werr, fmt.Errorf("delta data at %d has %d bytes", off, len(pt))
+			}
+			if werr == nil {
+				_, werr = out.WriteAt(pt, off)
+			}
+			off += int64(len(pt))
+			if err := onChunk(int64(len(pt))); err != nil {
+				return werr, err
+			}
+		}
+	}
+	return werr, nil
+}
@@ -0,0 +1,142 @@
+package transfer
+
+import (
+	"bytes"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// rebuild assembles newData on the receiver's side from the file at basePath, the way a
+// delta transfer does: the copies from the old file, then the literals no copy covers.
+func rebuild(t *testing.T, basePath string, copies []deltaCopy, newData []byte) ([]byte, int64) {
+	t.Helper()
+	out, err := os.Create(filepath.Join(t.TempDir(), "new.part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if err := out.Truncate(int64(len(newData))); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyCopies(out, basePath, copies); err != nil {
+		t.Fatal(err)
+	}
+	var literal int64
+	for _, r := range deltaLiterals(copies, int64(len(newData))) {
+		if _, err := out.WriteAt(newData[r.Offset:r.Offset+r.Length], r.Offset); err != nil {
+			t.Fatal(err)
+		}
+		literal += r.Length
+	}
+	got, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got, literal
+}
+
+func TestDeltaRebuildsMutatedFile(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(rng.Uint32())
+		}
+		return b
+	}
+	base := random(300 << 10)
+	basePath := filepath.Join(t.TempDir(), "old")
+	if err := os.WriteFile(basePath, base, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := deltaSignatureOf(basePath)
+	if err != nil || sig == nil || !sig.valid() {
+		t.Fatalf("signature %v, %v", sig, err)
+	}
+	bs := int(sig.BlockSize)
+
+	flipped := slices.Clone(base)
+	flipped[150<<10] ^= 0xff
+	for _, tc := range []struct {
+		name       string
+		data       []byte
+		maxLiteral int // bytes the sender may have to stream
+	}{
+		{"unchanged", base, 0},
+		{"byte changed", flipped, bs},
+		{"prefix inserted", slices.Concat(random(777), base), 777},
+		{"range deleted", slices.Concat(base[:100<<10], base[100<<10+5000:]), 2 * bs},
+		{"range inserted", slices.Concat(base[:200<<10], random(3000), base[200<<10:]), 3000 + 2*bs},
+		{"appended", slices.Concat(base, random(1234)), 1234 + bs},
+		{"truncated", base[:250<<10+17], bs},
+		{"blocks swapped", slices.Concat(base[200<<10:], base[:200<<10]), 2 * bs},
+		{"unrelated", random(100 << 10), 100 << 10},
+		{"shorter than a block", base[:bs-1], bs},
+		{"empty", nil, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			copies, err := computeDelta(bytes.NewReader(tc.data), int64(len(tc.data)), sig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !validDelta(copies, int64(len(tc.data)), sig.Size) {
+				t.Fatalf("computeDelta produced an invalid plan: %+v", copies)
+			}
+			got, literal := rebuild(t, basePath, copies, tc.data)
+			if !bytes.Equal(got, tc.data) {
+				t.Fatal("rebuilt file differs")
+			}
+			if literal > int64(tc.maxLiteral) {
+				t.Fatalf("%d literal bytes, want at most %d", literal, tc.maxLiteral)
+			}
+		})
+	}
+}
+
+func TestRollingSumRolls(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	data := make([]byte, 4096)
+	for i := range data {
+		data[i] = byte(rng.Uint32())
+	}
+	const window = 512
+	r := newRollingSum(data[:window])
+	for i := 1; i+window <= len(data); i++ {
+		r.roll(data[i-1], data[i+window-1])
+		if want := newRollingSum(data[i : i+window]).sum(); r.sum() != want {
+			t.Fatalf("at %d: rolled sum %08x, fresh sum %08x", i, r.sum(), want)
+		}
+	}
+}
+
+func TestValidDelta(t *testing.T) {
+	const size, baseSize = 1000, 800
+	for _, tc := range []struct {
+		name   string
+		copies []deltaCopy
+		ok     bool
+	}{
+		{"none", nil, true},
+		{"ordered", []deltaCopy{{From: 0, To: 0, Length: 100}, {From: 500, To: 100, Length: 300}, {From: 0, To: 900, Length: 100}}, true},
+		{"whole base", []deltaCopy{{From: 0, To: 200, Length: baseSize}}, true},
+		{"overlapping", []deltaCopy{{From: 0, To: 0, Length: 100}, {From: 200, To: 50, Length: 100}}, false},
+		{"out of order", []deltaCopy{{From: 0, To: 500, Length: 10}, {From: 0, To: 100, Length: 10}}, false},
+		{"past the new file", []deltaCopy{{From: 0, To: 950, Length: 100}}, false},
+		{"past the base", []deltaCopy{{From: 750, To: 0, Length: 100}}, false},
+		{"negative from", []deltaCopy{{From: -1, To: 0, Length: 10}}, false},
+		{"negative to", []deltaCopy{{From: 0, To: -10, Length: 10}}, false},
+		{"empty copy", []deltaCopy{{From: 0, To: 0, Length: 0}}, false},
+		{"negative length", []deltaCopy{{From: 100, To: 100, Length: -50}}, false},
+		{"to overflows", []deltaCopy{{From: 0, To: 10, Length: math.MaxInt64}}, false},
+		{"from overflows", []deltaCopy{{From: math.MaxInt64, To: 0, Length: 10}}, false},
+		{"both overflow", []deltaCopy{{From: 10, To: 10, Length: math.MaxInt64 - 5}}, false},
+	} {
+		if got := validDelta(tc.copies, size, baseSize); got != tc.ok {
+			t.Errorf("%s: validDelta = %v, want %v", tc.name, got, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package transfer
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Nonce direction markers. Messages from the sender use the base nonce as-is,
+// replies from the receiver flip the top bit of the first byte so both sides
+// can seal with the same key without ever reusing a nonce.
+const (
+	dirSender   byte = 0x00
+	dirReceiver byte = 0x80
+)
+
+// maxFrameLen bounds a single sealed frame. Chunks are at most ChunkSize plus GCM
+// overhead; the limit leaves room for batch manifests listing many files.
+const maxFrameLen = 64 << 20
+
+// nonceSeq yields GCM nonces: base (with direction bit) and a big-endian counter in the last 4 bytes.
+type nonceSeq struct {
+	base []byte
+	ctr  uint32
+}
+
+func newNonceSeq(base []byte, dir byte) *nonceSeq {
+	b := make([]byte, len(base))
+	copy(b, base)
+	b[0] ^= dir
+	return &nonceSeq{base: b}
+}
+
+func (s *nonceSeq) next() []byte {
+	n := make([]byte, len(s.base))
+	copy(n, s.base)
+	i := len(n) - 4
+	n[i+0] = byte(s.ctr >> 24)
+	n[i+1] = byte(s.ctr >> 16)
+	n[i+2] = byte(s.ctr >> 8)
+	n[i+3] = byte(s.ctr)
+	s.ctr++
+	return n
+}
+
+// writeSealed seals pt and writes it as uint32(len) | ciphertext.
+func writeSealed(w io.Writer, aead cipher.AEAD, nonce, pt, aad []byte) error {
+	ct := aead.Seal(nil, nonce, pt, aad)
+	if err := binary.Write(w, binary.BigEndian, uint32(len(ct))); err != nil {
+		return err
+	}
+	_, err := w.Write(ct)
+	return err
+}
+
+// readCiphertext reads a uint32(len) | ciphertext frame; the session opens it.
+func readCiphertext(r io.Reader) ([]byte, error) {
+	var clen uint32
+	if err := binary.Read(r, binary.BigEndian, &clen); err != nil {
+		return nil, err
+	}
+	if clen > maxFrameLen {
+		return nil, fmt.Errorf("frame too large: %d", clen)
+	}
+	ct := make([]byte, clen)
+	if _, err := io.ReadFull(r, ct); err != nil {
+		return nil, err
+	}
+	return ct, nil
+}
@@ -0,0 +1,122 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+
+	pcrypto "learnP2P/crypto"
+)
+
+// PeerIdentity is the verified identity of the remote side of a session.
+type PeerIdentity struct {
+	Name        string
+	Fingerprint string
+	// Pinned is set once KnownPeers tied Name to Fingerprint. Without it the name is only
+	// what the peer announced, and rules keyed by peer name do not apply.
+	Pinned bool
+}
+
+// identityMsg is exchanged right after the key shares (AAD="identity"). Sig is the
+// Ed25519 signature over identityContext, the sender's role and both key shares.
+type identityMsg struct {
+	Name string `json:"name"`
+	Key  []byte `json:"key"`
+	Sig  []byte `json:"sig"`
+}
+
+const identityContext = "learnP2P identity\x00"
+
+func identitySigned(role string, transcript []byte) []byte {
+	return append([]byte(identityContext+role+"\x00"), transcript...)
+}
+
+// exchangeIdentity proves our identity to the peer and verifies theirs against the
+// known-peers store, after the SAS comparison when one is configured. The receiver
+// speaks first, matching the key share order.
+func (s *session) exchangeIdentity(opts Options, role string) error {
+	id := opts.Identity
+	if id == nil {
+		var err error
+		if id, err = pcrypto.ProcessIdentity(); err != nil {
+			return fmt.Errorf("identity: %w", err)
+		}
+	}
+	peerRole := "sender"
+	if role == "sender" {
+		peerRole = "receiver"
+	}
+	send := func() error {
+		msg := identityMsg{Name: opts.Name, Key: id.PublicKey(), Sig: id.Sign(identitySigned(role, s.transcript))}
+		if err := s.writeJSON(msg, "identity"); err != nil {
+			return fmt.Errorf("write identity: %w", err)
+		}
+		if err := s.flush(); err != nil {
+			return fmt.Errorf("flush identity: %w", err)
+		}
+		return nil
+	}
+	if role == "receiver" {
+		if err := send(); err != nil {
+			return err
+		}
+	}
+	var peer identityMsg
+	if err := s.readJSON(&peer, "identity"); err != nil {
+		return fmt.Errorf("read %s identity: %w", peerRole, err)
+	}
+	if !pcrypto.VerifyIdentity(peer.Key, identitySigned(peerRole, s.transcript), peer.Sig) {
+		return fmt.Errorf("%s identity signature invalid", peerRole)
+	}
+	// The name is shown in prompts and pinned in known_peers, so it must be a single field;
+	// an unnamed peer gets through here, but Verify refuses to pin it
+	if peer.Name != "" {
+		if err := pcrypto.ValidPeerName(peer.Name); err != nil {
+			return fmt.Errorf("%s identity: %w", peerRole, err)
+		}
+	}
+	s.peer = PeerIdentity{Name: peer.Name, Fingerprint: pcrypto.Fingerprint(peer.Key)}
+	if role == "sender" {
+		if err := send(); err != nil {
+			return err
+		}
+	}
+	// Pin only once the user has compared codes, so a rejected peer is never remembered.
+	if opts.ConfirmSAS != nil {
+		if err := s.exchangeSAS(opts, role, PeerIdentity{Name: opts.Name, Fingerprint: id.Fingerprint()}); err != nil {
+			return err
+		}
+		s.verified = true
+	}
+	if err := checkKnownPeer(opts, s.peer); err != nil {
+		return err
+	}
+	s.peer.Pinned = opts.KnownPeers != nil
+	return nil
+}
+
+// checkKnownPeer applies trust-on-first-use pinning and shouts when a pin is violated.
+func checkKnownPeer(opts Options, p PeerIdentity) error {
+	if opts.KnownPeers == nil {
+		return nil
+	}
+	status, err := opts.KnownPeers.Verify(p.Name, p.Fingerprint, opts.AcceptChangedKey)
+	if errors.Is(err, pcrypto.ErrPeerKeyChanged) {
+		Printf("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@\n"+
+			"@    WARNING: PEER IDENTITY KEY HAS CHANGED!              @\n"+
+			"@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@\n"+
+			"Peer %q presented %s, which does not match the pinned key.\n"+
+			"Someone could be impersonating this peer, or it was reinstalled.\n"+
+			"Transfer refused. Re-run with --accept-changed-key to trust the new key.\n", p.Name, p.Fingerprint)
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("known peers: %w", err)
+	}
+	switch status {
+	case pcrypto.PeerNew:
+		Printf("Trusting new peer %q on first use (%s)\n", p.Name, p.Fingerprint)
+	case pcrypto.PeerChanged:
+		Printf("WARNING: peer %q identity key changed; re-pinned to %s (--accept-changed-key)\n", p.Name, p.Fingerprint)
+	}
+	return nil
+}
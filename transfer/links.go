@@ -0,0 +1,150 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Links in a directory batch. Symlinks are sent as links rather than followed, and a file
+// with several names below the root is sent once, its other names as hard links. Both are
+// created by the receiver after every file of the batch, so a link can never redirect a
+// write that belongs to the batch.
+
+// LinkPolicy decides what happens to a symlink whose target lies outside the batch root
+// (an absolute target, or one that climbs above the root). Links that stay inside the root
+// are always sent as links.
+type LinkPolicy string
+
+const (
+	LinkSkip   LinkPolicy = "skip"   // sender: leave it out; receiver: refuse to create it
+	LinkFollow LinkPolicy = "follow" // sender: send the regular file it points to instead
+	LinkKeep   LinkPolicy = "keep"   // send and create it as is
+)
+
+// ParseLinkPolicy validates a policy name; "" selects LinkSkip.
+func ParseLinkPolicy(s string) (LinkPolicy, error) {
+	switch p := LinkPolicy(s); p {
+	case "":
+		return LinkSkip, nil
+	case LinkSkip, LinkFollow, LinkKeep:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown link policy %q (want skip, follow or keep)", s)
+	}
+}
+
+// Link is a symlink or hard link of a batch. Name is the slash-separated path of the link
+// below the root. For a symlink Target is the link's contents in slash form; for a hard link
+// it is the batch path of the file sent under its first name.
+type Link struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+}
+
+// inode identifies a file on the sender, to find names of the same file.
+type inode struct {
+	dev, ino uint64
+}
+
+// linkInside reports whether the relative symlink target, read from the link at rel (a
+// slash-separated path below the root), stays below the root. ".." is only allowed as
+// leading elements and never more often than rel has parent directories: a ".." after a
+// name could step back out of another link, which a lexical check cannot see.
+func linkInside(rel, target string) bool {
+	if target == "" || path.IsAbs(target) || strings.Contains(target, "\\") || filepath.VolumeName(target) != "" {
+		return false
+	}
+	depth := strings.Count(rel, "/")
+	named := false
+	for _, e := range strings.Split(target, "/") {
+		switch {
+		case e == "" || e == ".":
+		case e == "..":
+			if named || depth == 0 {
+				return false
+			}
+			depth--
+		default:
+			named = true
+		}
+	}
+	return true
+}
+
+// safeLinkTarget returns the OS form of a received symlink target, sanitizing every name
+// in it like a batch path. A target that leaves the root is only allowed with LinkKeep.
+func safeLinkTarget(rel, target string, policy LinkPolicy) (string, error) {
+	if !linkInside(rel, target) {
+		if policy != LinkKeep {
+			return "", fmt.Errorf("%w: link target %q leaves the batch", ErrUnsafePath, target)
+		}
+		return filepath.FromSlash(target), nil
+	}
+	var parts []string
+	for _, e := range strings.Split(target, "/") {
+		switch e {
+		case "", ".":
+			continue
+		case "..":
+			parts = append(parts, e)
+			continue
+		}
+		clean, err := sanitizeName(e)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, clean)
+	}
+	if len(parts) == 0 {
+		return ".", nil
+	}
+	return filepath.Join(parts...), nil
+}
+
+// createSymlink creates the symlink l below rootPath. An existing link with the same target
+// is left as is; anything else of that name is never replaced.
+func createSymlink(rootPath string, l Link, policy LinkPolicy) error {
+	p, err := batchPath(rootPath, l.Name)
+	if err != nil {
+		return err
+	}
+	target, err := safeLinkTarget(l.Name, l.Target, policy)
+	if err != nil {
+		return err
+	}
+	if cur, err := os.Readlink(p); err == nil && cur == target {
+		return nil
+	}
+	if _, err := os.Lstat(p); !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrFileExists, l.Name)
+	}
+	return os.Symlink(target, p)
+}
+
+// createHardLink links l below rootPath to the file stored for its target. A name that
+// already refers to that file is left as is; anything else of that name is never replaced.
+func createHardLink(rootPath string, l Link, stored map[string]string) error {
+	p, err := batchPath(rootPath, l.Name)
+	if err != nil {
+		return err
+	}
+	target, ok := stored[l.Target]
+	if !ok {
+		return fmt.Errorf("link target %s was not received", l.Target)
+	}
+	tfi, err := os.Lstat(target)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(p); err == nil {
+		if os.SameFile(fi, tfi) {
+			return nil
+		}
+		return fmt.Errorf("%w: %s", ErrFileExists, l.Name)
+	}
+	return os.Link(target, p)
+}
@@ -1,11 +1,13 @@
 package transfer
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
+	"sync"
 )
 
 // Manifest describes the file to transfer.
@@ -13,26 +15,140 @@ type Manifest struct {
 	Name string `json:"name"`
 	Size int64  `json:"size"`
 	Hash string `json:"hash"` // hex-encoded SHA-256 of the file contents
+	// Chunks is the SHA-256 of each ChunkSize block of the file, concatenated, so every chunk
+	// can be verified as it arrives. It is omitted for a file of at most one chunk, whose only
+	// chunk hash is Hash.
+	Chunks []byte `json:"chunks,omitempty"`
+	// Holes lists the holes of a sparse file that span at least one chunk. Chunks inside a
+	// hole whose hash is that of zeros are not streamed; the receiver leaves them unwritten.
+	Holes []byteRange `json:"holes,omitempty"`
+	// Mode holds the permission bits and ModTime the modification time (Unix nanoseconds) of
+	// the sender's file; UID and GID are only sent by a sender running as root. The receiver's
+	// MetadataPolicy decides whether they are applied. Mode is a pointer so that a file
+	// without any permission bits (mode 0) is told apart from a manifest without a mode.
+	Mode    *uint32 `json:"mode,omitempty"`
+	ModTime int64   `json:"mtime,omitempty"`
+	UID     *int    `json:"uid,omitempty"`
+	GID     *int    `json:"gid,omitempty"`
 }
 
-// BuildManifest computes the SHA-256 and size for a local file.
+// offer is the first encrypted frame of a transfer (AAD="manifest"): either a single
+// file manifest or a batch manifest for a directory tree.
+type offer struct {
+	Type   string         `json:"type"` // "file", "batch", "stream" (see parallel.go) or "pull" (see pull.go)
+	File   *Manifest      `json:"file,omitempty"`
+	Batch  *BatchManifest `json:"batch,omitempty"`
+	Stream *streamJoin    `json:"stream,omitempty"`
+	Pull   *pullRequest   `json:"pull,omitempty"`
+	// Compression lists the chunk codecs the sender can use, preferred first.
+	Compression []string `json:"compression,omitempty"`
+}
+
+const (
+	offerFile  = "file"
+	offerBatch = "batch"
+)
+
+// BuildManifest computes the SHA-256, the chunk hashes and the size for a local file, and
+// records its metadata and the holes of a sparse file.
 func BuildManifest(path string) (Manifest, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return Manifest{}, err
 	}
 	defer f.Close()
-	h := sha256.New()
-	n, err := io.Copy(h, f)
+	fi, err := f.Stat()
 	if err != nil {
 		return Manifest{}, err
 	}
-	sum := h.Sum(nil)
-	return Manifest{
+	holes := fileHoles(f, fi.Size())
+	h := sha256.New()
+	var chunks []byte
+	var n int64
+	buf := make([]byte, ChunkSize)
+	for {
+		k, err := io.ReadFull(f, buf)
+		if k > 0 {
+			h.Write(buf[:k])
+			sum := sha256.Sum256(buf[:k])
+			chunks = append(chunks, sum[:]...)
+			n += int64(k)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return Manifest{}, err
+		}
+	}
+	m := Manifest{
 		Name: fileName(path),
 		Size: n,
-		Hash: hex.EncodeToString(sum),
-	}, nil
+		Hash: hex.EncodeToString(h.Sum(nil)),
+	}
+	// The file may have changed since its holes were found; inHole checks the chunk hashes
+	if n == fi.Size() {
+		m.Holes = holes
+	}
+	if n > ChunkSize {
+		m.Chunks = chunks
+	}
+	m.setMetadata(fi)
+	return m, nil
+}
+
+// chunkCount is the number of ChunkSize blocks in the file.
+func (m Manifest) chunkCount() int64 {
+	return (m.Size + ChunkSize - 1) / ChunkSize
+}
+
+// chunkHash returns the expected SHA-256 of block i.
+func (m Manifest) chunkHash(i int64) []byte {
+	if m.Chunks == nil {
+		sum, _ := hex.DecodeString(m.Hash)
+		return sum
+	}
+	return m.Chunks[i*sha256.Size : (i+1)*sha256.Size]
+}
+
+// zeroChunkHash is the SHA-256 of a full chunk of zeros.
+var zeroChunkHash = sync.OnceValue(func() [sha256.Size]byte {
+	return sha256.Sum256(make([]byte, ChunkSize))
+})
+
+// inHole reports whether block i lies inside one of the manifest's holes and its chunk hash
+// is that of zeros, so the receiver does not need its bytes.
+func (m Manifest) inHole(i int64) bool {
+	off := i * ChunkSize
+	n := min(ChunkSize, m.Size-off)
+	covered := false
+	for _, h := range m.Holes {
+		if h.Offset <= off && off+n <= h.Offset+h.Length {
+			covered = true
+			break
+		}
+	}
+	if !covered {
+		return false
+	}
+	zero := zeroChunkHash()
+	if n < ChunkSize {
+		zero = sha256.Sum256(make([]byte, n))
+	}
+	return bytes.Equal(m.chunkHash(i), zero[:])
+}
+
+// checkChunks validates the shape of the chunk hash list against the size.
+func (m Manifest) checkChunks() error {
+	switch {
+	case m.Size < 0:
+		return fmt.Errorf("%s: negative size", m.Name)
+	case m.Size <= ChunkSize && m.Chunks != nil:
+		return fmt.Errorf("%s: unexpected chunk hashes", m.Name)
+	case m.Size > ChunkSize && int64(len(m.Chunks)) != m.chunkCount()*sha256.Size:
+		return fmt.Errorf("%s: %d bytes of chunk hashes for %d chunks", m.Name, len(m.Chunks), m.chunkCount())
+	}
+	return nil
 }
 
 func fileName(path string) string {
@@ -0,0 +1,78 @@
+package transfer
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Chat messages. A short text travels in a session of its own, so it is encrypted and
+// authenticated like any transfer, and reaches only a peer that passed the same identity
+// checks (known peers, SAS):
+//
+//	key shares, identities (and SAS) as for a transfer
+//	sender -> message {text} (AAD="message")
+//
+// Text is at most MaxMessageLen bytes. The receiver drops control characters, so a message
+// cannot move the cursor, clear the screen or otherwise drive the terminal it is shown on.
+
+// MaxMessageLen bounds the text of one message.
+const MaxMessageLen = 4096
+
+// chatMessage is the only frame of a message session after the handshake.
+type chatMessage struct {
+	Text string `json:"text"`
+}
+
+// SendMessage sends text to the peer on conn, which runs ReceiveMessage.
+func SendMessage(conn net.Conn, text string, opts Options) error {
+	if len(text) > MaxMessageLen {
+		return fmt.Errorf("message longer than %d bytes", MaxMessageLen)
+	}
+	s, err := openSenderSession(conn, opts)
+	if err != nil {
+		return err
+	}
+	if err := s.writeJSON(chatMessage{Text: text}, "message"); err != nil {
+		return fmt.Errorf("write message: %w", err)
+	}
+	if err := s.flush(); err != nil {
+		return fmt.Errorf("flush message: %w", err)
+	}
+	return nil
+}
+
+// ReceiveMessage receives one message sent with SendMessage and returns who sent it and its
+// text, with control characters removed.
+func ReceiveMessage(conn net.Conn, opts Options) (PeerIdentity, string, error) {
+	s, err := openReceiverSession(conn, opts)
+	if err != nil {
+		return PeerIdentity{}, "", err
+	}
+	var m chatMessage
+	if err := s.readJSON(&m, "message"); err != nil {
+		return PeerIdentity{}, "", fmt.Errorf("read message: %w", err)
+	}
+	if len(m.Text) > MaxMessageLen {
+		return PeerIdentity{}, "", fmt.Errorf("message from %s longer than %d bytes", s.peer.Name, MaxMessageLen)
+	}
+	return s.peer, printableText(m.Text), nil
+}
+
+// printableText drops control characters, including bidirectional overrides, and replaces
+// invalid UTF-8; tabs become spaces.
+func printableText(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t':
+			return ' '
+		case r == utf8.RuneError:
+			return '?'
+		case unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r):
+			return -1
+		}
+		return r
+	}, text)
+}
@@ -0,0 +1,68 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// MetadataPolicy decides whether a received file takes the sender's metadata from the
+// manifest. It is applied once the file's SHA-256 has been verified, before it is renamed
+// into place.
+type MetadataPolicy string
+
+const (
+	MetadataHonor      MetadataPolicy = "honor"       // permission bits and modification time
+	MetadataHonorOwner MetadataPolicy = "honor-owner" // the same and, as root, the sender's owner and group
+	MetadataIgnore     MetadataPolicy = "ignore"      // default permissions and the time of receipt
+)
+
+// ParseMetadataPolicy validates a policy name; "" selects MetadataHonor.
+func ParseMetadataPolicy(s string) (MetadataPolicy, error) {
+	switch p := MetadataPolicy(s); p {
+	case "":
+		return MetadataHonor, nil
+	case MetadataHonor, MetadataHonorOwner, MetadataIgnore:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown metadata policy %q (want honor, honor-owner or ignore)", s)
+	}
+}
+
+// setMetadata records the metadata of fi in m. The owner is only included when this process
+// runs as root, since other senders' ids mean nothing to the receiver.
+func (m *Manifest) setMetadata(fi fs.FileInfo) {
+	mode := uint32(fi.Mode().Perm())
+	m.Mode = &mode
+	m.ModTime = fi.ModTime().UnixNano()
+	if os.Geteuid() == 0 {
+		if uid, gid, ok := fileOwner(fi); ok {
+			m.UID, m.GID = &uid, &gid
+		}
+	}
+}
+
+// applyMetadata gives the file at path the metadata carried by man. Only permission bits are
+// applied, never setuid, setgid or sticky. The owner, which lets the sender decide which local
+// user owns the file, only with MetadataHonorOwner and when this process runs as root.
+// Metadata missing from the manifest (a nil Mode, a zero ModTime) is left as it is.
+func applyMetadata(path string, man Manifest, policy MetadataPolicy) error {
+	if policy == MetadataIgnore {
+		return nil
+	}
+	var errs []error
+	// Owner first: changing it may clear mode bits
+	if policy == MetadataHonorOwner && man.UID != nil && man.GID != nil && os.Geteuid() == 0 {
+		errs = append(errs, os.Lchown(path, *man.UID, *man.GID))
+	}
+	if man.Mode != nil {
+		errs = append(errs, os.Chmod(path, fs.FileMode(*man.Mode).Perm()))
+	}
+	if man.ModTime != 0 {
+		// A zero access time is left unchanged
+		errs = append(errs, os.Chtimes(path, time.Time{}, time.Unix(0, man.ModTime)))
+	}
+	return errors.Join(errs...)
+}
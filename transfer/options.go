@@ -0,0 +1,128 @@
+package transfer
+
+import (
+	"io"
+	"net"
+
+	pcrypto "learnP2P/crypto"
+)
+
+// Options configures one side of a transfer. The zero value uses a throwaway
+// process identity and accepts whatever identity key the peer presents.
+type Options struct {
+	// Name is the node name announced alongside our identity key.
+	Name string
+	// Identity signs our key share; nil falls back to crypto.ProcessIdentity.
+	Identity *pcrypto.Identity
+	// KnownPeers pins peer identity keys on first use; nil disables pinning.
+	KnownPeers *pcrypto.KnownPeers
+	// AcceptChangedKey re-pins a known peer that presents a different key instead of refusing.
+	AcceptChangedKey bool
+
+	// ConfirmSAS, when set, is shown the short authentication string of each session and
+	// reports whether the user confirmed it matches the code on the peer's screen. Nothing is
+	// sent or written until both users confirm.
+	ConfirmSAS func(peer PeerIdentity, code string) bool
+	// ChannelBinding ties the SAS to the underlying transport (e.g. both DTLS fingerprints).
+	ChannelBinding []byte
+
+	// ReceiveDir is the directory received files are stored under; empty means PublicDir.
+	ReceiveDir string
+	// PeerDirs overrides ReceiveDir per sending peer, keyed by the peer's node name. It only
+	// applies to peers KnownPeers has pinned, since nothing else ties a name to a key.
+	PeerDirs map[string]string
+	// ConfirmOffer, when set, is shown each incoming offer that AutoAccept does not cover and
+	// reports whether to accept it. A declined offer is reported to the sender as ErrDeclined.
+	// Nil accepts every offer.
+	ConfirmOffer func(IncomingOffer) bool
+	// AutoAccept lists offers accepted without calling ConfirmOffer.
+	AutoAccept AcceptRules
+	// AckEvery, when > 0, makes the receiver acknowledge every AckEvery bytes it has written, so
+	// the sender's progress shows delivered rather than sent bytes.
+	AckEvery int64
+	// Compression is the chunk codec to offer (sender) or accept (receiver): CompressDeflate
+	// (the default when empty) or CompressNone.
+	Compression string
+	// Streams is how many connections the sender may use for one large file (see
+	// parallel.go); 0 or 1 keeps every file on the session's own connection.
+	Streams int
+	// OpenStream opens another connection to the same peer for a parallel transfer, e.g. a
+	// new authenticated TCP connection or WebRTC data channel. Nil disables parallel sends.
+	OpenStream func() (net.Conn, error)
+	// MaxStreams is how many connections the receiver accepts for one file; 0 or 1 refuses
+	// parallel transfers.
+	MaxStreams int
+	// JoinsOnly makes Receive take nothing but the extra streams of parallel transfers whose
+	// control session was verified, by a password handshake or the SAS comparison, and
+	// refuse any other offer. It is meant for connections that should not count as a peer
+	// of their own, such as extra WebRTC data channels, which the peer can open before it
+	// is verified.
+	JoinsOnly bool
+	// OnJoin, when set, is called once Receive accepted an extra stream into a pending
+	// parallel transfer, e.g. to stop counting its connection against a peer limit only then.
+	OnJoin func()
+	// Output, when set, receives single files in place of the receive directory, written in
+	// order as they arrive (e.g. os.Stdout). Directory batches are declined.
+	Output io.Writer
+	// Delta makes the receiver describe an existing file of the same name by block
+	// signatures, so the sender only streams the parts that changed (see delta.go).
+	Delta bool
+	// EscapingLinks decides what happens to a symlink in a directory batch whose target lies
+	// outside the batch root: the sender skips, follows or keeps it, and the receiver only
+	// creates one with LinkKeep. Empty means LinkSkip.
+	EscapingLinks LinkPolicy
+	// Metadata decides whether received files take the sender's permission bits, modification
+	// time and owner; empty means MetadataHonor, which leaves the owner alone.
+	Metadata MetadataPolicy
+	// Share is a directory peers may list and pull files from (see Pull); empty refuses
+	// pull requests. Nothing in it is ever written.
+	Share string
+	// OnConflict decides what happens when a received name is already taken; empty means
+	// ConflictRename.
+	OnConflict ConflictPolicy
+	// OnAbort decides what happens to the partial data of a file whose transfer was aborted
+	// by either side (see cancel.go); empty means PartialKeep.
+	OnAbort PartialPolicy
+
+	// cancel is set by the Context variants of Send and Receive.
+	cancel *canceler
+}
+
+// receiveDir returns the receive root for files from peer.
+func (o Options) receiveDir(peer PeerIdentity) string {
+	if d, ok := o.PeerDirs[peer.Name]; ok && d != "" && peer.Pinned {
+		return d
+	}
+	if o.ReceiveDir != "" {
+		return o.ReceiveDir
+	}
+	return PublicDir
+}
+
+func (o Options) escapingLinks() LinkPolicy {
+	if o.EscapingLinks == "" {
+		return LinkSkip
+	}
+	return o.EscapingLinks
+}
+
+func (o Options) metadataPolicy() MetadataPolicy {
+	if o.Metadata == "" {
+		return MetadataHonor
+	}
+	return o.Metadata
+}
+
+func (o Options) conflictPolicy() ConflictPolicy {
+	if o.OnConflict == "" {
+		return ConflictRename
+	}
+	return o.OnConflict
+}
+
+func (o Options) partialPolicy() PartialPolicy {
+	if o.OnAbort == "" {
+		return PartialKeep
+	}
+	return o.OnAbort
+}
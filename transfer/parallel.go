@@ -0,0 +1,363 @@
+package transfer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// Parallel streams. One ordered connection (a TCP socket, or a single SCTP data channel)
+// caps throughput on high-latency links, so the ranges a receiver needs of a large file can be
+// spread over several connections at once. The file's own session stays the control stream:
+//
+//	receiver -> resume request {need, streams: max it accepts, token}
+//	sender   opens extra connections; on each a full session (key shares, identities) whose
+//	         offer is {type: "stream", stream: {token, index}}; the receiver accepts it only if
+//	         the token is pending and the identity matches the control session's peer
+//	sender   -> resume reply {streams}: the needed ranges split into one list per stream;
+//	         list 0 follows on the control stream, list i on extra stream i, as ordinary chunks.
+//	         The receiver refuses a plan that counts on a stream that has not joined
+//	receiver -> per extra stream: a receipt for its ranges, after which the sender closes it
+//	receiver -> on the control stream: the file receipt, after hashing the whole .part
+//
+// The receiver verifies each chunk and writes it at its offset. Chunks lost with a failed
+// stream are simply still needed on the next attempt.
+
+// ErrStreamDone is returned by Receive once a connection that only carried one range of a
+// parallel transfer has delivered it; the sender closes such connections afterwards.
+var ErrStreamDone = errors.New("parallel stream finished")
+
+const offerStream = "stream"
+
+// parallelMinRange is the smallest share of a file worth a stream of its own.
+const parallelMinRange = 4 * ChunkSize
+
+// streamJoin attaches an extra connection to a pending parallel transfer.
+type streamJoin struct {
+	Token string `json:"token"`
+	Index int    `json:"index"` // 1..n; list 0 travels on the control stream
+}
+
+// byteRange is one contiguous part of a file.
+type byteRange struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// splitNeed divides the needed ranges into n lists of whole chunks, as even as possible,
+// cutting ranges where needed. With n no larger than the number of chunks, every list is
+// non-empty.
+func splitNeed(need []byteRange, n int) [][]byteRange {
+	var chunks int64
+	for _, r := range need {
+		chunks += (r.Length + ChunkSize - 1) / ChunkSize
+	}
+	out := make([][]byteRange, n)
+	i, quota := 0, chunks/int64(n)+min(1, chunks%int64(n))
+	for _, r := range need {
+		for r.Length > 0 {
+			take := min(quota*ChunkSize, r.Length)
+			out[i] = append(out[i], byteRange{Offset: r.Offset, Length: take})
+			quota -= (take + ChunkSize - 1) / ChunkSize
+			r.Offset += take
+			r.Length -= take
+			if quota == 0 && i+1 < n {
+				i++
+				quota = chunks / int64(n)
+				if int64(i) < chunks%int64(n) {
+					quota++
+				}
+			}
+		}
+	}
+	return out
+}
+
+// validSplit checks that the per-stream lists are chunk-aligned and together are exactly need.
+func validSplit(streams [][]byteRange, need []byteRange, size int64) bool {
+	var all []byteRange
+	for _, list := range streams {
+		if len(list) == 0 || !validNeed(list, size) {
+			return false
+		}
+		for _, r := range list {
+			all = appendRange(all, r)
+		}
+	}
+	if len(all) != len(need) {
+		return false
+	}
+	for i := range all {
+		if all[i] != need[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// streamCount is how many streams the sender uses for the rest of a file.
+func streamCount(want, allowed int, remaining int64) int {
+	n := min(want, allowed, int(remaining/parallelMinRange))
+	return max(n, 1)
+}
+
+// newStreamToken returns a random token naming one parallel transfer.
+func newStreamToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// streamGroup is a parallel transfer pending or running on the receiver. Extra streams join
+// it by token; they wait on ready until the control stream has the sender's plan.
+type streamGroup struct {
+	peer     string // identity fingerprint of the control session's peer
+	codec    string
+	verified bool // the control session was verified (see Options.JoinsOnly)
+
+	ready   chan struct{} // closed once the plan is known, or the group is dropped
+	once    sync.Once
+	mu      sync.Mutex
+	joined  map[int]bool
+	man     Manifest
+	out     *os.File
+	streams [][]byteRange
+	aad     []byte
+	prog    *progress
+	results chan streamResult
+}
+
+// streamResult is how one stream of a parallel transfer ended.
+type streamResult struct {
+	bad int // chunks that failed verification
+	err error
+}
+
+var (
+	groupsMu sync.Mutex
+	groups   = make(map[string]*streamGroup)
+)
+
+// registerGroup makes token joinable by extra streams from peer.
+func registerGroup(token, peer, codec string, verified bool) *streamGroup {
+	g := &streamGroup{peer: peer, codec: codec, verified: verified, ready: make(chan struct{}), joined: make(map[int]bool)}
+	groupsMu.Lock()
+	groups[token] = g
+	groupsMu.Unlock()
+	return g
+}
+
+// dropGroup stops accepting joins for token and releases streams still waiting for a plan.
+func dropGroup(token string, g *streamGroup) {
+	groupsMu.Lock()
+	delete(groups, token)
+	groupsMu.Unlock()
+	g.once.Do(func() { close(g.ready) })
+}
+
+// start publishes the plan; extra streams begin writing their ranges into out.
+func (g *streamGroup) start(man Manifest, out *os.File, streams [][]byteRange, aad []byte, prog *progress) {
+	g.mu.Lock()
+	g.man, g.out, g.streams, g.aad, g.prog = man, out, streams, aad, prog
+	g.results = make(chan streamResult, len(streams))
+	g.mu.Unlock()
+	g.once.Do(func() { close(g.ready) })
+}
+
+// join claims index for a new extra stream.
+func (g *streamGroup) join(index int) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if index < 1 || g.joined[index] {
+		return false
+	}
+	g.joined[index] = true
+	return true
+}
+
+// joinedAll reports whether extra streams 1..n-1 have all joined.
+func (g *streamGroup) joinedAll(n int) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i := 1; i < n; i++ {
+		if !g.joined[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// receive reads stream i's ranges from s into the group's file.
+func (g *streamGroup) receive(s *session, i int) streamResult {
+	bad, werr, err := receiveChunks(s, g.man, g.out, g.streams[i], g.aad, func(n int64) error {
+		g.prog.add(n)
+		return nil
+	})
+	return streamResult{bad: bad, err: errors.Join(err, werr)}
+}
+
+// receiveJoin serves an extra stream: it waits for the plan, writes its ranges and sends the
+// stream's receipt.
+func receiveJoin(s *session, j streamJoin, opts Options) error {
+	groupsMu.Lock()
+	g := groups[j.Token]
+	groupsMu.Unlock()
+	reply := offerReply{Accept: true}
+	switch {
+	case g == nil:
+		reply = offerReply{Reason: "unknown or expired stream token"}
+	case g.peer != s.peer.Fingerprint:
+		reply = offerReply{Reason: "stream opened by a different peer"}
+	case opts.JoinsOnly && !g.verified:
+		reply = offerReply{Reason: "stream of a transfer whose peer was not verified"}
+	case !g.join(j.Index):
+		reply = offerReply{Reason: "invalid or duplicate stream index"}
+	default:
+		reply.Compression = g.codec
+	}
+	if err := s.writeJSON(reply, "offer-reply"); err != nil {
+		return fmt.Errorf("write offer reply: %w", err)
+	}
+	if err := s.flush(); err != nil {
+		return fmt.Errorf("flush offer reply: %w", err)
+	}
+	if !reply.Accept {
+		return fmt.Errorf("refused parallel stream: %s", reply.Reason)
+	}
+	if opts.OnJoin != nil {
+		opts.OnJoin()
+	}
+	codec, err := newChunkCodec(g.codec)
+	if err != nil {
+		return err
+	}
+	s.codec = codec
+
+	<-g.ready
+	g.mu.Lock()
+	planned := j.Index < len(g.streams)
+	g.mu.Unlock()
+	if !planned {
+		return ErrStreamDone // not needed for this file; the sender closes the stream
+	}
+	res := g.receive(s, j.Index)
+	g.results <- res
+	if res.err != nil {
+		return res.err
+	}
+	if err := s.writeReceipt(fileReceipt{Received: rangesLen(g.streams[j.Index]), Done: true, OK: true}); err != nil {
+		return err
+	}
+	return ErrStreamDone
+}
+
+// receiveParallel runs the control stream's share of a parallel transfer into out and waits
+// for the extra streams. Chunks that failed verification or were lost with a stream are
+// still missing from the .part, so the receipt asks for a retry that only covers those.
+// An abort on the control stream is returned as the error.
+func receiveParallel(s *session, g *streamGroup, man Manifest, out *os.File, streams [][]byteRange, aad []byte) (fileReceipt, error) {
+	var need int64
+	for _, list := range streams {
+		need += rangesLen(list)
+	}
+	prog := startProgress("Receiving", man.Name, man.Size-need, man.Size)
+	defer prog.finish()
+	Printf("Receiving %s over %d streams\n", man.Name, len(streams))
+	g.start(man, out, streams, aad, prog)
+
+	res := []streamResult{g.receive(s, 0)}
+	for range streams[1:] {
+		res = append(res, <-g.results)
+	}
+	if errors.Is(res[0].err, ErrAborted) {
+		return fileReceipt{}, res[0].err
+	}
+	r := fileReceipt{Received: man.Size, Done: true}
+	var bad int
+	var errs []error
+	for _, sr := range res {
+		bad += sr.bad
+		errs = append(errs, sr.err)
+	}
+	switch err := errors.Join(errs...); {
+	case err != nil:
+		r.Reason = fmt.Sprintf("parallel stream failed: %v", err)
+		r.Retry = true
+	case bad > 0:
+		r.Reason = fmt.Sprintf("%d chunk(s) failed verification", bad)
+		r.Retry = true
+	}
+	return r, nil
+}
+
+// openStreams opens up to n extra streams for token and joins each to the receiver's
+// pending transfer. It stops at the first connection that cannot be opened or is refused
+// (e.g. the receiver is busy), so the indices it returns are 1..len.
+func (s *session) openStreams(opts Options, token string, n int) []*session {
+	extra := opts
+	extra.ConfirmSAS = nil // the control session already verified this peer
+	var out []*session
+	for i := 1; i < n; i++ {
+		conn, err := opts.OpenStream()
+		if err != nil {
+			Printf("Parallel stream %d: %v\n", i, err)
+			break
+		}
+		es, err := joinStream(conn, extra, s, streamJoin{Token: token, Index: i})
+		if err != nil {
+			conn.Close()
+			Printf("Parallel stream %d: %v\n", i, err)
+			break
+		}
+		out = append(out, es)
+	}
+	return out
+}
+
+// joinStream opens a session on conn and attaches it to the receiver's transfer.
+func joinStream(conn net.Conn, opts Options, control *session, j streamJoin) (*session, error) {
+	es, err := openSenderSession(conn, opts)
+	if err != nil {
+		return nil, err
+	}
+	if es.peer.Fingerprint != control.peer.Fingerprint {
+		return nil, errors.New("stream reached a different peer")
+	}
+	if err := es.writeJSON(offer{Type: offerStream, Stream: &j, Compression: []string{control.codec.name}}, "manifest"); err != nil {
+		return nil, fmt.Errorf("write stream offer: %w", err)
+	}
+	if err := es.flush(); err != nil {
+		return nil, fmt.Errorf("flush stream offer: %w", err)
+	}
+	if err := es.awaitAcceptance(); err != nil {
+		return nil, err
+	}
+	es.conn = conn
+	return es, nil
+}
+
+// sendExtra streams ranges on an extra stream, waits for its receipt and closes it.
+func sendExtra(es *session, f *os.File, ranges []byteRange, aad []byte, prog *progress) error {
+	defer es.conn.Close()
+	if err := sendRanges(es, f, ranges, aad, prog); err != nil {
+		return err
+	}
+	var rc fileReceipt
+	if err := es.readJSON(&rc, "receipt"); err != nil {
+		return fmt.Errorf("read stream receipt: %w", err)
+	}
+	if !rc.OK || rc.Received != rangesLen(ranges) {
+		return errors.New("stream not confirmed by the receiver")
+	}
+	return nil
+}
+
+func closeStreams(extras []*session) {
+	for _, es := range extras {
+		es.conn.Close()
+	}
+}
@@ -3,6 +3,7 @@ package transfer
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -88,34 +89,144 @@ func formatETA(remaining int64, rate float64) string {
 	return fmt.Sprintf("%02d:%02d", m, s)
 }
 
-// printProgress prints a single-line progress with carriage return for in-place updates.
+// Progress output is shared by every transfer in the process. Running transfers own the
+// bottom line of the terminal: one transfer gets the detailed bar, several get a compact
+// combined line. Other output goes through Printf, which clears that line first and
+// redraws it afterwards, so concurrent transfers never interleave mid-line.
 // Example: "Sending file.bin |##########------|  62.3%  12.3 MiB/19.7 MiB  8.4 MiB/s  ETA 00:01"
-var lastProgressLen int
+var (
+	progressMu      sync.Mutex
+	activeProgress  []*progress
+	lastProgressLen int
+)
+
+// progress tracks one running file transfer.
+type progress struct {
+	prefix, name string
+	done, total  int64
+	base         int64 // bytes already present at start, left out of the rate
+	start        time.Time
+	lastTick     time.Time
+}
+
+// startProgress registers a transfer of total bytes, of which done are already present.
+func startProgress(prefix, name string, done, total int64) *progress {
+	p := &progress{prefix: prefix, name: name, done: done, total: total, base: done, start: time.Now()}
+	progressMu.Lock()
+	activeProgress = append(activeProgress, p)
+	drawProgressLocked()
+	progressMu.Unlock()
+	return p
+}
+
+// update records done bytes, redrawing at most every 200ms.
+func (p *progress) update(done int64) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	p.done = done
+	if now := time.Now(); now.Sub(p.lastTick) >= 200*time.Millisecond {
+		p.lastTick = now
+		drawProgressLocked()
+	}
+}
 
-func printProgress(prefix, name string, done, total int64, start time.Time) {
-	if total <= 0 {
-		total = 1
+// add records n more bytes; parallel streams of one file share a progress.
+func (p *progress) add(n int64) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	p.done += n
+	if now := time.Now(); now.Sub(p.lastTick) >= 200*time.Millisecond {
+		p.lastTick = now
+		drawProgressLocked()
 	}
-	pct := float64(done) / float64(total)
-	elapsed := time.Since(start).Seconds()
+}
+
+// finish prints the transfer's final bar as a permanent line and stops tracking it.
+// Later calls do nothing, so it can also be deferred for error paths.
+func (p *progress) finish() {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	i := 0
+	for i < len(activeProgress) && activeProgress[i] != p {
+		i++
+	}
+	if i == len(activeProgress) {
+		return
+	}
+	activeProgress = append(activeProgress[:i], activeProgress[i+1:]...)
+	clearProgressLocked()
+	fmt.Println(p.line())
+	drawProgressLocked()
+}
+
+// Printf prints a message without garbling the progress line of running transfers.
+func Printf(format string, args ...any) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	clearProgressLocked()
+	fmt.Printf(format, args...)
+	drawProgressLocked()
+}
+
+func (p *progress) rate() float64 {
+	elapsed := time.Since(p.start).Seconds()
 	if elapsed < 1e-9 {
 		elapsed = 1e-9
 	}
-	rate := float64(done) / elapsed
-	eta := formatETA(total-done, rate)
-	bar := renderBar(pct, 20)
-	line := fmt.Sprintf("%s %s |%s| %6.2f%%  %s/%s  %s  ETA %s",
-		prefix, name, bar, pct*100,
-		humanBytes(done), humanBytes(total), humanRate(rate), eta,
+	return float64(p.done-p.base) / elapsed
+}
+
+func (p *progress) pct() float64 {
+	if p.total <= 0 {
+		return 1
+	}
+	return float64(p.done) / float64(p.total)
+}
+
+// line renders the detailed single-transfer bar; a stream of unknown size has no bar.
+func (p *progress) line() string {
+	rate := p.rate()
+	if p.total < 0 {
+		return fmt.Sprintf("%s %s  %s  %s", p.prefix, p.name, humanBytes(p.done), humanRate(rate))
+	}
+	return fmt.Sprintf("%s %s |%s| %6.2f%%  %s/%s  %s  ETA %s",
+		p.prefix, p.name, renderBar(p.pct(), 20), p.pct()*100,
+		humanBytes(p.done), humanBytes(p.total), humanRate(rate), formatETA(p.total-p.done, rate),
 	)
+}
+
+// drawProgressLocked redraws the progress line in place; callers hold progressMu.
+func drawProgressLocked() {
+	var line string
+	switch len(activeProgress) {
+	case 0:
+		return
+	case 1:
+		line = activeProgress[0].line()
+	default:
+		parts := make([]string, len(activeProgress))
+		for i, p := range activeProgress {
+			if p.total < 0 {
+				parts[i] = fmt.Sprintf("[%s %s %s]", p.name, humanBytes(p.done), humanRate(p.rate()))
+			} else {
+				parts[i] = fmt.Sprintf("[%s %.0f%% %s]", p.name, p.pct()*100, humanRate(p.rate()))
+			}
+		}
+		line = fmt.Sprintf("%d transfers %s", len(activeProgress), strings.Join(parts, " "))
+	}
 	// Pad with spaces if the new line is shorter than the previous to clear leftovers
 	if lastProgressLen > len(line) {
 		line += strings.Repeat(" ", lastProgressLen-len(line))
 	}
 	fmt.Print("\r" + line)
 	lastProgressLen = len(line)
-	// On completion, reset tracking so next progress starts cleanly
-	if done >= total {
-		lastProgressLen = 0
+}
+
+// clearProgressLocked blanks the progress line so other output starts at column 0.
+func clearProgressLocked() {
+	if lastProgressLen == 0 {
+		return
 	}
+	fmt.Print("\r" + strings.Repeat(" ", lastProgressLen) + "\r")
+	lastProgressLen = 0
 }
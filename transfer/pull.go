@@ -0,0 +1,297 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Pull mode. A node with Options.Share lets authenticated peers list that directory and
+// fetch files from it. The peer that dialed still opens the session as the sender, but asks
+// instead of offering, and the roles of the transfer that follows are swapped:
+//
+//	puller -> offer {type: "pull", pull: {op: "list" | "get", path, fileOnly}, compression}
+//	          (AAD="manifest")
+//	owner  -> pull reply {error | listing | file | batch, compression} (AAD="pull")
+//	then, for a file or batch, the owner sends it exactly as Send does from step 4 on, and the
+//	puller stores it like any received transfer (conflict policy, metadata, batch summary)
+//
+// Paths are slash-separated and relative to the share. Every request is resolved with its
+// symlinks and refused unless it stays inside the share. A refusal leaves the session usable.
+
+const (
+	offerPull = "pull"
+
+	pullList = "list"
+	pullGet  = "get"
+)
+
+// maxShareEntries bounds a listing so it fits in one frame.
+const maxShareEntries = 10000
+
+// ErrRefused is returned by List and Pull when the peer refuses the request, e.g. because it
+// shares nothing or the path does not exist. The connection stays usable.
+var ErrRefused = errors.New("pull request refused")
+
+// ErrServed is returned by Receive once it has answered a pull request instead of receiving.
+// The connection stays usable.
+var ErrServed = errors.New("pull request served")
+
+// pullRequest asks the owner of a share for a listing or a file.
+type pullRequest struct {
+	Op       string `json:"op"`
+	Path     string `json:"path"`
+	FileOnly bool   `json:"fileOnly,omitempty"` // refuse directories (the puller writes to Options.Output)
+}
+
+// pullReply answers a pullRequest. Compression is the chunk codec the owner picked from the
+// request's list.
+type pullReply struct {
+	Error       string         `json:"error,omitempty"`
+	Listing     *ShareListing  `json:"listing,omitempty"`
+	File        *Manifest      `json:"file,omitempty"`
+	Batch       *BatchManifest `json:"batch,omitempty"`
+	Compression string         `json:"compression,omitempty"`
+}
+
+func (r *pullReply) printable() { r.Error = printableText(r.Error) }
+
+// ShareListing is the content of one directory of a peer's share.
+type ShareListing struct {
+	Path      string       `json:"path"`
+	Entries   []ShareEntry `json:"entries"`
+	Truncated bool         `json:"truncated,omitempty"` // more than maxShareEntries entries
+}
+
+// ShareEntry is a file or directory in a ShareListing. ModTime is in Unix nanoseconds.
+type ShareEntry struct {
+	Name    string `json:"name"`
+	Dir     bool   `json:"dir,omitempty"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+}
+
+// List asks the peer for the entries of dir in its share ("" for the top).
+func List(conn net.Conn, dir string, opts Options) (ShareListing, error) {
+	s, rep, err := requestPull(conn, pullRequest{Op: pullList, Path: dir}, opts)
+	if err != nil {
+		return ShareListing{}, err
+	}
+	if rep.Listing == nil {
+		return ShareListing{}, fmt.Errorf("%s sent no listing", s.peer.Name)
+	}
+	return *rep.Listing, nil
+}
+
+// Pull fetches the file or directory at remotePath from the peer's share and stores it as
+// Receive would a transfer from that peer, or writes a single file to opts.Output. It returns
+// the manifest (for a directory: root name and total size) and where it was stored.
+func Pull(conn net.Conn, remotePath string, opts Options) (Manifest, string, error) {
+	req := pullRequest{Op: pullGet, Path: remotePath, FileOnly: opts.Output != nil}
+	s, rep, err := requestPull(conn, req, opts)
+	if err != nil {
+		return Manifest{}, "", err
+	}
+	switch {
+	case rep.File != nil:
+		if rep.File.Size == SizeUnknown {
+			return Manifest{}, "", errors.New("pull reply announces a stream")
+		}
+		return receiveOffer(s, offer{Type: offerFile, File: rep.File}, opts)
+	case rep.Batch != nil && opts.Output == nil:
+		return receiveOffer(s, offer{Type: offerBatch, Batch: rep.Batch}, opts)
+	default:
+		return Manifest{}, "", errors.New("unexpected pull reply")
+	}
+}
+
+// requestPull opens a session, sends req and reads the owner's reply.
+func requestPull(conn net.Conn, req pullRequest, opts Options) (*session, pullReply, error) {
+	s, err := openSenderSession(conn, opts)
+	if err != nil {
+		return nil, pullReply{}, err
+	}
+	if err := s.writeJSON(offer{Type: offerPull, Pull: &req, Compression: opts.compressionOffer()}, "manifest"); err != nil {
+		return nil, pullReply{}, fmt.Errorf("write pull request: %w", err)
+	}
+	if err := s.flush(); err != nil {
+		return nil, pullReply{}, fmt.Errorf("flush pull request: %w", err)
+	}
+	var rep pullReply
+	if err := s.readJSON(&rep, "pull"); err != nil {
+		return nil, pullReply{}, fmt.Errorf("read pull reply: %w", err)
+	}
+	if rep.Error != "" {
+		return nil, pullReply{}, fmt.Errorf("%w by %s: %s", ErrRefused, s.peer.Name, rep.Error)
+	}
+	codec, err := newChunkCodec(rep.Compression)
+	if err != nil {
+		return nil, pullReply{}, err
+	}
+	s.codec = codec
+	return s, rep, nil
+}
+
+// servePull answers a pull request from opts.Share and, for a file or directory, sends it.
+// A request that was answered, even with a refusal, or a file the puller could not store
+// returns ErrServed; other errors leave the session out of sync.
+func servePull(s *session, req pullRequest, offered []string, opts Options) error {
+	rep := pullReply{Compression: opts.pickCompression(offered)}
+	p, err := sharedPath(opts.Share, req.Path)
+	var fi os.FileInfo
+	if err == nil {
+		fi, err = os.Stat(p)
+	}
+	switch {
+	case opts.Share == "":
+		rep.Error = "this node shares nothing"
+	case err != nil:
+		rep.Error = shareError(req.Path, err)
+	case req.Op == pullList && !fi.IsDir():
+		rep.Error = req.Path + " is not a directory"
+	case req.Op == pullList:
+		if rep.Listing, err = listShared(opts.Share, req.Path, p); err != nil {
+			rep.Error = shareError(req.Path, err)
+		}
+	case req.Op != pullGet:
+		rep.Error = fmt.Sprintf("unknown request %q", req.Op)
+	case fi.IsDir() && req.FileOnly:
+		rep.Error = req.Path + " is a directory"
+	case fi.IsDir():
+		// Links that leave the share are never followed
+		links := opts.escapingLinks()
+		if links == LinkFollow {
+			links = LinkSkip
+		}
+		b, err := BuildBatchManifest(p, links)
+		if err != nil {
+			rep.Error = shareError(req.Path, err)
+		} else {
+			if name := path.Base(strings.Trim(req.Path, "/")); name != "." {
+				b.Root = name // the name asked for, not that of a symlink's target
+			}
+			rep.Batch = &b
+		}
+	case fi.Mode().IsRegular():
+		m, err := BuildManifest(p)
+		if err != nil {
+			rep.Error = shareError(req.Path, err)
+		} else {
+			m.Name = path.Base(strings.Trim(req.Path, "/"))
+			rep.File = &m
+		}
+	default:
+		rep.Error = req.Path + " is not a regular file"
+	}
+	if rep.Error != "" {
+		rep.Compression = ""
+	}
+	if err := s.writeJSON(rep, "pull"); err != nil {
+		return fmt.Errorf("write pull reply: %w", err)
+	}
+	if err := s.flush(); err != nil {
+		return fmt.Errorf("flush pull reply: %w", err)
+	}
+	if rep.Error != "" {
+		return fmt.Errorf("%w: refused %s %q from %s: %s", ErrServed, req.Op, req.Path, s.peer.Name, rep.Error)
+	}
+	if rep.Listing != nil {
+		return fmt.Errorf("%w: listed %q for %s", ErrServed, req.Path, s.peer.Name)
+	}
+	codec, err := newChunkCodec(rep.Compression)
+	if err != nil {
+		return err
+	}
+	s.codec = codec
+
+	Printf("%s pulls %s\n", s.peer.Name, req.Path)
+	if rep.Batch != nil {
+		err = sendBatchFiles(s, p, *rep.Batch, opts)
+	} else {
+		err = sendFile(s, p, *rep.File, opts)
+	}
+	var fe *fileError
+	if errors.As(err, &fe) {
+		return fmt.Errorf("%w: %s to %s failed: %v", ErrServed, req.Path, s.peer.Name, err)
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: sent %s to %s", ErrServed, req.Path, s.peer.Name)
+}
+
+// sharedPath resolves the slash-separated path rel below root with every symlink followed.
+// The result must stay inside root.
+func sharedPath(root, rel string) (string, error) {
+	if root == "" {
+		return "", errors.New("no share")
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	rel = strings.Trim(rel, "/")
+	if rel == "" {
+		return realRoot, nil
+	}
+	if strings.Contains(rel, "\\") || !filepath.IsLocal(filepath.FromSlash(rel)) {
+		return "", fmt.Errorf("%w: %q", ErrUnsafePath, rel)
+	}
+	p, err := filepath.EvalSymlinks(filepath.Join(realRoot, filepath.FromSlash(rel)))
+	if err != nil {
+		return "", err
+	}
+	if r, err := filepath.Rel(realRoot, p); err != nil || (r != "." && !filepath.IsLocal(r)) {
+		return "", fmt.Errorf("%w: %q leaves the shared directory", ErrUnsafePath, rel)
+	}
+	return p, nil
+}
+
+// listShared lists the directory dir, found at p, of the share at root. Entries that are not
+// regular files or directories, or lead out of the share, are left out.
+func listShared(root, dir, p string) (*ShareListing, error) {
+	des, err := os.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	l := &ShareListing{Path: strings.Trim(dir, "/"), Entries: []ShareEntry{}}
+	for _, de := range des {
+		if len(l.Entries) == maxShareEntries {
+			l.Truncated = true
+			break
+		}
+		ep, err := sharedPath(root, path.Join(l.Path, de.Name()))
+		if err != nil {
+			continue
+		}
+		fi, err := os.Stat(ep)
+		if err != nil || (!fi.IsDir() && !fi.Mode().IsRegular()) {
+			continue
+		}
+		e := ShareEntry{Name: de.Name(), Dir: fi.IsDir(), ModTime: fi.ModTime().UnixNano()}
+		if !e.Dir {
+			e.Size = fi.Size()
+		}
+		l.Entries = append(l.Entries, e)
+	}
+	return l, nil
+}
+
+// shareError describes err for the puller without revealing where the share lives.
+func shareError(rel string, err error) string {
+	switch {
+	case errors.Is(err, ErrUnsafePath):
+		return err.Error()
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Sprintf("%q does not exist", rel)
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Sprintf("%q is not readable", rel)
+	default:
+		return fmt.Sprintf("%q is not available", rel)
+	}
+}
@@ -0,0 +1,50 @@
+package transfer
+
+import "fmt"
+
+// fileReceipt is the receiver's report on one streamed file (AAD="receipt"). It travels
+// inside the session, so it is authenticated by the same identity-bound key as the data.
+// With acknowledgements enabled (resumeRequest.AckEvery), interim receipts with Done unset
+// report how many bytes the receiver has written so far.
+type fileReceipt struct {
+	Received int64  `json:"received"`
+	Done     bool   `json:"done,omitempty"`
+	OK       bool   `json:"ok,omitempty"`     // SHA-256 verified and the file is in place
+	Hash     string `json:"hash,omitempty"`   // SHA-256 (hex) computed by the receiver
+	Stored   string `json:"stored,omitempty"` // path the receiver stored the file at
+	Reason   string `json:"reason,omitempty"` // why the file was not stored
+	Retry    bool   `json:"retry,omitempty"`  // integrity failure: both sides go back to resume negotiation
+}
+
+func (r *fileReceipt) printable() {
+	r.Stored, r.Reason = printableText(r.Stored), printableText(r.Reason)
+}
+
+// maxAttempts bounds how often a file failing its integrity check is sent.
+const maxAttempts = 3
+
+// writeReceipt sends the receiver's receipt for a file. A sender that canceled closes the
+// connection right after its abort, so a failed write reports the abort if there is one.
+func (s *session) writeReceipt(r fileReceipt) error {
+	if err := s.writeJSON(r, "receipt"); err != nil {
+		return s.pendingAbort(fmt.Errorf("write receipt: %w", err))
+	}
+	if err := s.flush(); err != nil {
+		return s.pendingAbort(fmt.Errorf("flush receipt: %w", err))
+	}
+	return nil
+}
+
+// readReceipt reads receipts until the final one, reporting acknowledged bytes to prog.
+func (s *session) readReceipt(prog *progress) (fileReceipt, error) {
+	for {
+		var r fileReceipt
+		if err := s.readJSON(&r, "receipt"); err != nil {
+			return r, fmt.Errorf("read receipt: %w", err)
+		}
+		if r.Done {
+			return r, nil
+		}
+		prog.update(r.Received)
+	}
+}
@@ -1,189 +1,485 @@
 package transfer
 
 import (
-	"bufio"
+	"bytes"
 	"crypto/sha256"
-	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
-
-	pcrypto "learnP2P/crypto"
 )
 
 const PublicDir = "public"
 
-// Receive reads manifest then file chunks, storing to public/<name>. It validates total size.
-func Receive(conn net.Conn) (Manifest, string, error) {
-	br := bufio.NewReader(conn)
-	bw := bufio.NewWriter(conn)
-
-	// 0) Send our RSA public key first: 0x01 | uint32(len) | pubDER
-	priv, err := pcrypto.GetOrCreateRSA4096()
+// Receive reads manifest then file chunks, storing to <dir>/<name> where dir is the receive
+// directory configured for the sending peer (public by default). It validates total size.
+// Every chunk is checked against the manifest's chunk hashes as it arrives; chunks an existing
+// <name>.part already holds intact are not requested again. With opts.Delta, a file whose name
+// is taken is received as a delta against the existing one. A name that is already taken is
+// handled by opts.OnConflict before any data is streamed.
+// A streamed file of unknown size (see SendStream) is verified against the hash sent after it.
+// With opts.Output set, single files are written there instead and batches are declined.
+// A connection opened only to carry part of a parallel transfer returns ErrStreamDone, and a
+// pull request for opts.Share is answered and returns ErrServed (see pull.go).
+// For a batch, the tree is recreated under <dir>/<root> and the returned manifest carries the
+// root name and total size; per-file failures are reported in the batch summary.
+func Receive(conn net.Conn, opts Options) (Manifest, string, error) {
+	s, err := openReceiverSession(conn, opts)
 	if err != nil {
-		return Manifest{}, "", fmt.Errorf("rsa key: %w", err)
+		return Manifest{}, "", err
 	}
-	pubDER, err := pcrypto.MarshalPublicKeyDER(&priv.PublicKey)
-	if err != nil {
-		return Manifest{}, "", fmt.Errorf("marshal pubkey: %w", err)
+
+	// 2) Read encrypted manifest
+	var o offer
+	if err := s.readJSON(&o, "manifest"); err != nil {
+		return Manifest{}, "", fmt.Errorf("read manifest: %w", err)
 	}
-	if err := bw.WriteByte(0x01); err != nil {
-		return Manifest{}, "", fmt.Errorf("write pubkey tag: %w", err)
+	// An extra connection of a parallel transfer carries one range of a file offered elsewhere
+	if o.Type == offerStream && o.Stream != nil {
+		return Manifest{}, "", receiveJoin(s, *o.Stream, opts)
 	}
-	if err := binary.Write(bw, binary.BigEndian, uint32(len(pubDER))); err != nil {
-		return Manifest{}, "", fmt.Errorf("write pubkey len: %w", err)
+	if opts.JoinsOnly {
+		return Manifest{}, "", s.refuseOffer(o, "this connection only carries parallel streams")
+	}
+	// The peer asks for our shared files; we become the sender
+	if o.Type == offerPull && o.Pull != nil {
+		return Manifest{}, "", servePull(s, *o.Pull, o.Compression, opts)
+	}
+
+	// Let the receiving user accept or decline before anything touches the disk
+	if err := s.decideOffer(opts, o); err != nil {
+		return Manifest{}, "", err
+	}
+	return receiveOffer(s, o, opts)
+}
+
+// receiveOffer receives the accepted file or batch o.
+func receiveOffer(s *session, o offer, opts Options) (Manifest, string, error) {
+	if o.Type == offerFile && o.File != nil && opts.Output != nil {
+		return receiveToOutput(s, *o.File, opts)
 	}
-	if _, err := bw.Write(pubDER); err != nil {
-		return Manifest{}, "", fmt.Errorf("write pubkey der: %w", err)
+
+	// Ensure the receive dir exists
+	dir := opts.receiveDir(s.peer)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return Manifest{}, "", fmt.Errorf("mkdir receive dir: %w", err)
 	}
-	if err := bw.Flush(); err != nil {
-		return Manifest{}, "", fmt.Errorf("flush pubkey: %w", err)
+
+	switch {
+	case o.Type == offerFile && o.File != nil:
+		man := *o.File
+		outPath, err := outputPath(dir, man.Name)
+		if err != nil {
+			return Manifest{}, "", skipFile(s, err)
+		}
+		if man.Size == SizeUnknown {
+			return receiveStream(s, man, outPath, opts)
+		}
+		outPath, err = receiveFile(s, man, outPath, opts)
+		if err != nil {
+			return Manifest{}, "", err
+		}
+		return man, outPath, nil
+	case o.Type == offerBatch && o.Batch != nil:
+		return receiveBatch(s, *o.Batch, dir, opts)
+	default:
+		return Manifest{}, "", fmt.Errorf("unexpected offer type: %q", o.Type)
 	}
+}
 
-	// 1) Read header: version(0x02), encKeyLen, encKey(RSA-OAEP), base nonce
-	ver, err := br.ReadByte()
+// receiveBatch recreates the directory tree, receives every file in manifest order, creates
+// the batch's links and sends the final summary back to the sender.
+// An existing root directory is merged into; the conflict policy applies to each file.
+func receiveBatch(s *session, b BatchManifest, dir string, opts Options) (Manifest, string, error) {
+	rootPath, err := outputPath(dir, b.Root)
 	if err != nil {
-		return Manifest{}, "", fmt.Errorf("read header version: %w", err)
+		return Manifest{}, "", fmt.Errorf("invalid batch root: %w", err)
+	}
+	if err := os.MkdirAll(rootPath, 0o755); err != nil {
+		return Manifest{}, "", fmt.Errorf("mkdir batch root: %w", err)
+	}
+	sum := BatchSummary{
+		Root:      b.Root,
+		Received:  []string{},
+		EmptyDirs: b.emptyDirs(),
+		Failed:    append([]FileFailure{}, b.Failed...),
+	}
+	for _, d := range b.Dirs {
+		dirPath, err := batchPath(rootPath, d)
+		if err == nil {
+			err = os.MkdirAll(dirPath, 0o755)
+		}
+		if err != nil {
+			sum.Failed = append(sum.Failed, FileFailure{Path: d, Reason: err.Error()})
+		}
 	}
-	if ver != 0x02 {
-		return Manifest{}, "", fmt.Errorf("unexpected header version: %d", ver)
+
+	Printf("Receiving %s: %d file(s), %d dir(s), %s\n", b.Root, len(b.Files), len(b.Dirs), humanBytes(b.Size))
+	stored := make(map[string]string) // batch path -> where the file was stored, for hard links
+	for _, m := range b.Files {
+		outPath, err := batchPath(rootPath, m.Name)
+		if err != nil {
+			err = skipFile(s, err)
+		} else {
+			outPath, err = receiveFile(s, m, outPath, opts)
+		}
+		var fe *fileError
+		if errors.As(err, &fe) {
+			sum.Failed = append(sum.Failed, FileFailure{Path: m.Name, Reason: err.Error()})
+			continue
+		}
+		if err != nil {
+			return Manifest{}, "", fmt.Errorf("receive %s: %w", m.Name, err)
+		}
+		sum.Received = append(sum.Received, m.Name)
+		sum.Bytes += m.Size
+		stored[m.Name] = outPath
 	}
-	var ekLen uint32
-	if err := binary.Read(br, binary.BigEndian, &ekLen); err != nil {
-		return Manifest{}, "", fmt.Errorf("read encKey len: %w", err)
+
+	// Links come last, so none of them can redirect a write of this batch
+	for _, l := range b.Symlinks {
+		if err := createSymlink(rootPath, l, opts.escapingLinks()); err != nil {
+			sum.Failed = append(sum.Failed, FileFailure{Path: l.Name, Reason: err.Error()})
+			continue
+		}
+		sum.Links = append(sum.Links, l.Name)
 	}
-	if ekLen == 0 || ekLen > 10_000 { // RSA-4096 OAEP ciphertext size is ~512 bytes
-		return Manifest{}, "", fmt.Errorf("invalid encKey len: %d", ekLen)
+	for _, l := range b.HardLinks {
+		if err := createHardLink(rootPath, l, stored); err != nil {
+			sum.Failed = append(sum.Failed, FileFailure{Path: l.Name, Reason: err.Error()})
+			continue
+		}
+		sum.Links = append(sum.Links, l.Name)
 	}
-	encKey := make([]byte, ekLen)
-	if _, err := io.ReadFull(br, encKey); err != nil {
-		return Manifest{}, "", fmt.Errorf("read encKey: %w", err)
+
+	if err := s.writeJSON(sum, "summary"); err != nil {
+		return Manifest{}, "", s.pendingAbort(fmt.Errorf("write batch summary: %w", err))
 	}
-	base := make([]byte, pcrypto.NonceSize)
-	if _, err := io.ReadFull(br, base); err != nil {
-		return Manifest{}, "", fmt.Errorf("read base nonce: %w", err)
+	if err := s.flush(); err != nil {
+		return Manifest{}, "", s.pendingAbort(fmt.Errorf("flush batch summary: %w", err))
 	}
-	key, err := pcrypto.DecryptKeyRSAOAEP(priv, encKey)
+	Printf("%s\n", sum.Pretty())
+	return Manifest{Name: b.Root, Size: b.Size}, rootPath, nil
+}
+
+// outputPath maps a single remote file or batch root name into dir (see safepath.go).
+func outputPath(dir, name string) (string, error) {
+	clean, err := sanitizeName(name)
 	if err != nil {
-		return Manifest{}, "", fmt.Errorf("rsa-oaep decrypt: %w", err)
+		return "", err
 	}
-	aead, err := pcrypto.NewGCM(key)
+	return safeJoin(dir, clean)
+}
+
+// batchPath maps a slash-separated batch path below rootPath, rejecting anything that escapes it.
+func batchPath(rootPath, rel string) (string, error) {
+	p, err := safeRelPath(rel)
 	if err != nil {
-		return Manifest{}, "", err
+		return "", err
 	}
-	var ctr uint32
-	nonceFor := func() []byte {
-		n := make([]byte, len(base))
-		copy(n, base)
-		i := len(n) - 4
-		n[i+0] = byte(ctr >> 24)
-		n[i+1] = byte(ctr >> 16)
-		n[i+2] = byte(ctr >> 8)
-		n[i+3] = byte(ctr)
-		ctr++
-		return n
+	return safeJoin(rootPath, p)
+}
+
+// skipFile declines the next file of a batch so the sender moves on without streaming it.
+func skipFile(s *session, cause error) error {
+	if err := s.sendResume(resumeRequest{Skip: true, Reason: cause.Error()}); err != nil {
+		return err
 	}
+	return &fileError{cause}
+}
 
-	// 2) Read encrypted manifest
-	var clen uint32
-	if err := binary.Read(br, binary.BigEndian, &clen); err != nil {
-		return Manifest{}, "", fmt.Errorf("read manifest len: %w", err)
+// sendResume writes the receiver's per-file resume request; a failed write reports the
+// sender's abort if there is one (see writeReceipt).
+func (s *session) sendResume(req resumeRequest) error {
+	if err := s.writeJSON(req, "resume"); err != nil {
+		return s.pendingAbort(fmt.Errorf("write resume request: %w", err))
 	}
-	cman := make([]byte, clen)
-	if _, err := io.ReadFull(br, cman); err != nil {
-		return Manifest{}, "", fmt.Errorf("read manifest: %w", err)
+	if err := s.flush(); err != nil {
+		return s.pendingAbort(fmt.Errorf("flush resume request: %w", err))
+	}
+	return nil
+}
+
+// inFlight holds the .part paths written by receives running in this process, so two peers
+// sending the same name at once cannot interleave their bytes in one file.
+var (
+	inFlightMu sync.Mutex
+	inFlight   = make(map[string]bool)
+)
+
+func claimPath(p string) bool {
+	inFlightMu.Lock()
+	defer inFlightMu.Unlock()
+	p = filepath.Clean(p)
+	if inFlight[p] {
+		return false
 	}
-	mbytes, err := aead.Open(nil, nonceFor(), cman, []byte("manifest"))
+	inFlight[p] = true
+	return true
+}
+
+func releasePath(p string) {
+	inFlightMu.Lock()
+	delete(inFlight, filepath.Clean(p))
+	inFlightMu.Unlock()
+}
+
+// receiveFile applies the conflict policy, then receives the file into <path>.part, verifies
+// the SHA-256, renames the result into place and reports the outcome to the sender in a
+// receipt. A file with chunks failing verification is requested again, up to maxAttempts in
+// total; later attempts only ask for the chunks still missing.
+// It returns the path the file was stored at.
+func receiveFile(s *session, man Manifest, outPath string, opts Options) (string, error) {
+	if err := man.checkChunks(); err != nil {
+		return "", skipFile(s, err)
+	}
+	requested := outPath
+	outPath, conflict, err := placeFile(outPath, man, opts.conflictPolicy())
 	if err != nil {
-		return Manifest{}, "", fmt.Errorf("decrypt manifest: %w", err)
+		return "", skipFile(s, err)
+	}
+	if conflict == conflictIdentical {
+		Printf("%s: identical file already present, skipped\n", man.Name)
+		return outPath, s.sendResume(resumeRequest{Skip: true, Conflict: conflict, Stored: filepath.Base(outPath)})
+	}
+	defer releasePath(outPath + ".part")
+	switch conflict {
+	case conflictRenamed:
+		Printf("%s exists; storing as %s\n", man.Name, filepath.Base(outPath))
+	case conflictOverwritten:
+		Printf("%s exists; overwriting\n", man.Name)
 	}
-	var man Manifest
-	if err := json.Unmarshal(mbytes, &man); err != nil {
-		return Manifest{}, "", fmt.Errorf("decode manifest: %w", err)
+	// The file that held the name is an older version the sender can build on
+	var base string
+	if opts.Delta && conflict != "" {
+		base = requested
 	}
 
-	// Ensure public dir exists
-	if err := os.MkdirAll(PublicDir, 0o755); err != nil {
-		return Manifest{}, "", fmt.Errorf("mkdir public: %w", err)
+	for attempt := 1; ; attempt++ {
+		r, err := receiveAttempt(s, man, outPath, conflict, base, opts)
+		if err != nil {
+			opts.dropPartial(outPath+".part", err)
+			return "", err
+		}
+		r.Retry = r.Retry && attempt < maxAttempts
+		if err := s.writeReceipt(r); err != nil {
+			return "", err
+		}
+		if r.OK {
+			return outPath, nil
+		}
+		if !r.Retry {
+			return "", &fileError{errors.New(r.Reason)}
+		}
+		Printf("%s: %s; requesting it again (attempt %d of %d)\n", man.Name, r.Reason, attempt+1, maxAttempts)
+		conflict, base = "", "" // already reported; retries only ask for missing chunks
 	}
-	outPath := filepath.Join(PublicDir, man.Name)
+}
+
+// receiveAttempt negotiates which chunks are still needed and receives one pass of them.
+// With nothing usable in the .part, the existing file at base (if any) is offered for a delta
+// transfer. It returns the final receipt; an error means nothing more is exchanged for this file.
+func receiveAttempt(s *session, man Manifest, outPath, conflict, base string, opts Options) (fileReceipt, error) {
 	tmpPath := outPath + ".part"
+	// AAD bytes for chunks
+	hashBytes, derr := hex.DecodeString(man.Hash)
+	if derr != nil {
+		return fileReceipt{}, fmt.Errorf("decode hash: %w", derr)
+	}
 
-	// Receive file data
-	out, err := os.Create(tmpPath)
+	// Ask only for the chunks the .part file does not already hold intact
+	need, have, holes := neededRanges(tmpPath, man)
+	out, err := openPart(tmpPath, os.O_CREATE|os.O_WRONLY)
 	if err != nil {
-		return Manifest{}, "", fmt.Errorf("create file: %w", err)
+		return fileReceipt{}, skipFile(s, fmt.Errorf("create file: %w", err))
 	}
 	defer out.Close()
+	ackEvery := opts.AckEvery
+	req := resumeRequest{Need: need, Conflict: conflict, AckEvery: ackEvery}
+	if conflict != "" {
+		req.Stored = filepath.Base(outPath)
+	}
+	if base != "" && have == 0 && holes == 0 {
+		sig, err := deltaSignatureOf(base)
+		if err != nil {
+			Printf("%s: existing copy not usable for delta: %v\n", man.Name, err)
+		}
+		req.Delta = sig
+	}
+	// Let the sender split a large file across extra streams
+	var g *streamGroup
+	if opts.MaxStreams > 1 && rangesLen(need) >= 2*parallelMinRange {
+		req.Streams, req.Token = opts.MaxStreams, newStreamToken()
+		g = registerGroup(req.Token, s.peer.Fingerprint, s.codec.name, s.verified)
+		defer dropGroup(req.Token, g)
+	}
+	if err := s.sendResume(req); err != nil {
+		return fileReceipt{}, err
+	}
+	var rep resumeReply
+	if err := s.readJSON(&rep, "resume"); err != nil {
+		return fileReceipt{}, fmt.Errorf("read resume reply: %w", err)
+	}
+	if rep.Skip {
+		return fileReceipt{}, &fileError{fmt.Errorf("sender skipped file: %s", rep.Reason)}
+	}
+	// Every extra stream the plan counts on must have joined already: the sender only sends
+	// the plan once the receiver accepted each of them
+	if len(rep.Streams) > 0 && (g == nil || len(rep.Streams) > req.Streams || !validSplit(rep.Streams, need, man.Size) || !g.joinedAll(len(rep.Streams))) {
+		return fileReceipt{}, errors.New("invalid parallel stream plan")
+	}
+	if rep.Delta != nil && (req.Delta == nil || len(rep.Streams) > 0 || !validDelta(rep.Delta.Copies, man.Size, req.Delta.Size)) {
+		return fileReceipt{}, errors.New("invalid delta plan")
+	}
+	if have > 0 {
+		Printf("Resuming %s: %s already verified\n", man.Name, humanBytes(have))
+	}
+	if holes > 0 {
+		Printf("Sparse %s: %s of holes recreated without transfer\n", man.Name, humanBytes(holes))
+	}
 
-	var written int64
-	// Compute SHA-256 on the fly and compare to manifest at the end
-	h := sha256.New()
-	// AAD bytes for chunks
-	hashBytes, derr := hex.DecodeString(man.Hash)
-	if derr != nil {
-		return Manifest{}, "", fmt.Errorf("decode hash: %w", derr)
-	}
-	start := time.Now()
-	lastTick := time.Time{}
-	for written < man.Size {
-		// Each incoming chunk is len+ciphertext
-		var clen uint32
-		if err := binary.Read(br, binary.BigEndian, &clen); err != nil {
-			if err == io.EOF && written == man.Size {
-				break
-			}
-			return Manifest{}, "", fmt.Errorf("read chunk len: %w", err)
+	// Chunks are written at their offsets; the .part takes the file's size up front. A local
+	// write error does not abort the session: remaining chunks are drained so a batch can continue.
+	werr := out.Truncate(man.Size)
+	if len(rep.Streams) > 0 {
+		if werr != nil {
+			return fileReceipt{}, fmt.Errorf("prepare file: %w", werr)
 		}
-		ct := make([]byte, clen)
-		if _, err := io.ReadFull(br, ct); err != nil {
-			return Manifest{}, "", fmt.Errorf("read chunk: %w", err)
+		if r, err := receiveParallel(s, g, man, out, rep.Streams, hashBytes); err != nil || r.Reason != "" {
+			return r, err
 		}
-		pt, err := aead.Open(nil, nonceFor(), ct, hashBytes)
-		if err != nil {
-			return Manifest{}, "", fmt.Errorf("decrypt chunk: %w", err)
+		return finishFile(man, out, tmpPath, outPath, opts)
+	}
+	// A delta fills the .part from the existing copy first; only the rest is streamed
+	ranges := need
+	var cerr error
+	if rep.Delta != nil {
+		if werr == nil {
+			cerr = applyCopies(out, base, rep.Delta.Copies)
 		}
-		if _, werr := out.Write(pt); werr != nil {
-			return Manifest{}, "", fmt.Errorf("write file: %w", werr)
+		ranges = deltaLiterals(rep.Delta.Copies, man.Size)
+		have = man.Size - rangesLen(ranges)
+		Printf("Delta %s: reusing %s of the existing copy, receiving %s\n", man.Name, humanBytes(have), humanBytes(rangesLen(ranges)))
+	}
+	written := have + holes
+	lastAck := written
+	prog := startProgress("Receiving", man.Name, written, man.Size)
+	defer prog.finish()
+	onChunk := func(n int64) error {
+		written += n
+		prog.update(written)
+		if ackEvery > 0 && written-lastAck >= ackEvery && written < man.Size {
+			if err := s.writeReceipt(fileReceipt{Received: written}); err != nil {
+				return err
+			}
+			lastAck = written
 		}
-		_, _ = h.Write(pt)
-		written += int64(len(pt))
+		return nil
+	}
+	var bad int
+	var cwerr error
+	if rep.Delta != nil {
+		cwerr, err = receiveLiterals(s, out, ranges, hashBytes, onChunk)
+	} else {
+		bad, cwerr, err = receiveChunks(s, man, out, ranges, hashBytes, onChunk)
+	}
+	if err != nil {
+		return fileReceipt{}, err
+	}
+	if werr == nil {
+		werr = cwerr
+	}
+	if werr != nil {
+		return fileReceipt{Received: written, Done: true, Reason: fmt.Sprintf("write file: %v", werr)}, nil
+	}
+	if cerr != nil {
+		// The next attempt asks for whatever the .part still lacks, without a delta
+		return fileReceipt{Received: written, Done: true, Reason: fmt.Sprintf("apply delta: %v", cerr), Retry: true}, nil
+	}
+	// Final progress update
+	prog.finish()
+	if bad > 0 {
+		return fileReceipt{Received: written, Done: true, Reason: fmt.Sprintf("%d chunk(s) failed verification", bad), Retry: true}, nil
+	}
+	return finishFile(man, out, tmpPath, outPath, opts)
+}
 
-		now := time.Now()
-		if lastTick.IsZero() || now.Sub(lastTick) >= 200*time.Millisecond {
-			printProgress("Receiving", man.Name, written, man.Size, start)
-			lastTick = now
+// receiveChunks reads the chunks of ranges from s in order, checks each against the
+// manifest's chunk hash and writes the good ones into out at their offsets. A chunk that
+// fails its hash is left out and counted in bad; the next attempt asks for it again.
+// A local write error does not end the stream: the remaining chunks are drained and the
+// first write error is returned as werr. onChunk is called with each chunk's length; an
+// error from it, like a stream error, is returned as err.
+func receiveChunks(s *session, man Manifest, out io.WriterAt, ranges []byteRange, aad []byte, onChunk func(int64) error) (bad int, werr, err error) {
+	for _, r := range ranges {
+		for off := r.Offset; off < r.Offset+r.Length; {
+			// Each incoming chunk is len+ciphertext
+			body, err := s.readFrame(aad)
+			if err != nil {
+				return bad, werr, fmt.Errorf("read chunk: %w", err)
+			}
+			pt, err := s.codec.decode(body)
+			if err != nil {
+				return bad, werr, fmt.Errorf("read chunk: %w", err)
+			}
+			if int64(len(pt)) != min(ChunkSize, r.Offset+r.Length-off) {
+				return bad, werr, fmt.Errorf("chunk at %d has %d bytes", off, len(pt))
+			}
+			if sum := sha256.Sum256(pt); !bytes.Equal(sum[:], man.chunkHash(off/ChunkSize)) {
+				bad++
+			} else if werr == nil {
+				_, werr = out.WriteAt(pt, off)
+			}
+			off += int64(len(pt))
+			if err := onChunk(int64(len(pt))); err != nil {
+				return bad, werr, err
+			}
 		}
 	}
+	return bad, werr, nil
+}
 
+// finishFile closes the .part, checks its SHA-256 against the manifest, applies the sender's
+// metadata per policy and renames it into place. Every chunk was verified on arrival; this
+// also catches a chunk list that does not add up to the file. A transfer canceled meanwhile
+// leaves the file as .part and returns ErrAborted, so the partial data policy decides.
+func finishFile(man Manifest, out *os.File, tmpPath, outPath string, opts Options) (fileReceipt, error) {
+	r := fileReceipt{Received: man.Size, Done: true}
 	if err := out.Close(); err != nil {
-		return Manifest{}, "", fmt.Errorf("close output: %w", err)
+		r.Reason = fmt.Sprintf("close output: %v", err)
+		return r, nil
 	}
-	// Final progress update
-	printProgress("Receiving", man.Name, written, man.Size, start)
-	fmt.Print("\n")
 
 	// Verify SHA-256 matches manifest, with simple logging
-	fmt.Printf("Verifying integrity (SHA-256) for %s... ", man.Name)
 	vstart := time.Now()
-	calc := hex.EncodeToString(h.Sum(nil))
-	if calc != man.Hash {
-		fmt.Printf("FAILED (expected %s, got %s)\n", man.Hash, calc)
-		// Cleanup partial file
-		_ = out.Close()
+	r.Hash = fileHash(tmpPath)
+	if r.Hash != man.Hash {
+		Printf("Verifying integrity (SHA-256) for %s... FAILED (expected %s, got %s)\n", man.Name, man.Hash, r.Hash)
+		// Cleanup partial file; a retry starts from scratch
 		_ = os.Remove(tmpPath)
-		return Manifest{}, "", fmt.Errorf("hash mismatch: got %s, expected %s", calc, man.Hash)
+		r.Reason = fmt.Sprintf("hash mismatch: got %s, expected %s", r.Hash, man.Hash)
+		r.Retry = true
+		return r, nil
+	}
+	Printf("Verifying integrity (SHA-256) for %s... OK (took %s)\n", man.Name, time.Since(vstart).Round(time.Millisecond))
+	// The contents are fine; metadata that cannot be applied is only reported
+	if err := applyMetadata(tmpPath, man, opts.metadataPolicy()); err != nil {
+		Printf("%s: could not apply file metadata: %v\n", man.Name, err)
 	}
-	fmt.Printf("OK (took %s)\n", time.Since(vstart).Round(time.Millisecond))
 
+	if opts.cancel.canceled() {
+		return fileReceipt{}, opts.cancel.err()
+	}
 	if err := os.Rename(tmpPath, outPath); err != nil {
-		return Manifest{}, "", fmt.Errorf("finalize file: %w", err)
+		r.Reason = fmt.Sprintf("finalize file: %v", err)
+		return r, nil
 	}
-
-	return man, outPath, nil
+	r.OK = true
+	r.Stored = filepath.ToSlash(outPath)
+	return r, nil
 }
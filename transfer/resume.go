@@ -0,0 +1,119 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+)
+
+// resumeRequest is sent by the receiver after the manifest: the chunk-aligned byte ranges
+// of the file it still needs. Chunks its .part file already holds are verified against the
+// manifest's chunk hashes and left out, so a transfer resumes from any chunk boundary and a
+// retry only asks for the chunks that failed.
+// Skip tells the sender the receiver cannot store this file at all.
+// Conflict reports how an existing file of the same name was handled ("renamed",
+// "overwritten" or "identical", the last with Skip set) and Stored the name used.
+// AckEvery asks for interim receipts while streaming (see fileReceipt); Streams and Token
+// offer a parallel transfer (see parallel.go) and Delta describes an older copy the sender
+// can build on (see delta.go).
+type resumeRequest struct {
+	Need     []byteRange     `json:"need"`
+	Skip     bool            `json:"skip,omitempty"`
+	Reason   string          `json:"reason,omitempty"`
+	Conflict string          `json:"conflict,omitempty"`
+	Stored   string          `json:"stored,omitempty"`
+	AckEvery int64           `json:"ackEvery,omitempty"` // bytes between interim receipts; 0 = final receipt only
+	Streams  int             `json:"streams,omitempty"`  // most streams the receiver accepts for this file
+	Token    string          `json:"token,omitempty"`    // names the transfer for extra streams
+	Delta    *deltaSignature `json:"delta,omitempty"`
+}
+
+// resumeReply is the sender's answer. Skip means the sender cannot read the file and no
+// chunks follow. Streams, when set, splits the needed ranges across the control stream
+// (entry 0) and the extra streams that joined; otherwise every needed range follows on the
+// control stream, in order. Delta, when set, replaces the needed chunks with copies from the
+// receiver's older copy followed by the bytes they do not cover.
+type resumeReply struct {
+	Streams [][]byteRange `json:"streams,omitempty"`
+	Delta   *deltaPlan    `json:"delta,omitempty"`
+	Skip    bool          `json:"skip,omitempty"`
+	Reason  string        `json:"reason,omitempty"`
+}
+
+func (r *resumeRequest) printable() {
+	r.Reason, r.Stored = printableText(r.Reason), printableText(r.Stored)
+}
+
+func (r *resumeReply) printable() { r.Reason = printableText(r.Reason) }
+
+// neededRanges reads an existing .part file chunk by chunk and returns the ranges whose
+// contents do not match the manifest's chunk hashes, merged, along with the number of
+// verified bytes. A missing or unreadable .part needs the whole file, except for the chunks
+// in holes of a sparse file the .part does not reach yet: those are zeros once it takes the
+// file's size, and are counted in holes.
+func neededRanges(tmpPath string, man Manifest) (need []byteRange, have, holes int64) {
+	f, err := openPart(tmpPath, os.O_RDONLY)
+	if err == nil {
+		defer f.Close()
+	}
+	buf := make([]byte, ChunkSize)
+	for i := int64(0); i < man.chunkCount(); i++ {
+		r := byteRange{Offset: i * ChunkSize, Length: min(ChunkSize, man.Size-i*ChunkSize)}
+		// ReadAt fails on a short read, so a truncated .part needs its tail
+		read := false
+		if f != nil {
+			_, err := f.ReadAt(buf[:r.Length], r.Offset)
+			read = err == nil
+		}
+		switch {
+		case read && !chunkMatches(buf[:r.Length], man.chunkHash(i)):
+			need = appendRange(need, r)
+		case man.inHole(i):
+			holes += r.Length
+		case read:
+			have += r.Length
+		default:
+			need = appendRange(need, r)
+		}
+	}
+	return need, have, holes
+}
+
+// chunkMatches reports whether chunk has the SHA-256 want.
+func chunkMatches(chunk, want []byte) bool {
+	sum := sha256.Sum256(chunk)
+	return bytes.Equal(sum[:], want)
+}
+
+// appendRange adds r to ranges, merging it into the last range when they touch.
+func appendRange(ranges []byteRange, r byteRange) []byteRange {
+	if n := len(ranges); n > 0 && ranges[n-1].Offset+ranges[n-1].Length == r.Offset {
+		ranges[n-1].Length += r.Length
+		return ranges
+	}
+	return append(ranges, r)
+}
+
+// validNeed checks that a receiver's ranges are chunk-aligned, ordered, disjoint and inside
+// the file.
+func validNeed(need []byteRange, size int64) bool {
+	var next int64
+	for _, r := range need {
+		end := r.Offset + r.Length
+		if r.Offset < next || r.Offset%ChunkSize != 0 || r.Length <= 0 || end > size ||
+			(end%ChunkSize != 0 && end != size) {
+			return false
+		}
+		next = end
+	}
+	return true
+}
+
+// rangesLen sums the lengths of ranges.
+func rangesLen(ranges []byteRange) int64 {
+	var n int64
+	for _, r := range ranges {
+		n += r.Length
+	}
+	return n
+}
@@ -0,0 +1,147 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrUnsafePath is returned for a remote file name that cannot be stored safely.
+var ErrUnsafePath = errors.New("unsafe path")
+
+const (
+	maxNameLen = 250  // bytes per path element: the common 255 limit minus the ".part" suffix
+	maxPathLen = 4096 // bytes for a whole relative path inside a batch
+)
+
+// Names in a manifest come from the peer and are never trusted. Every element goes through
+// sanitizeName and every output path through safeJoin:
+//   - rejected: empty names, "." and "..", separators inside one element, absolute paths and
+//     volume names, NUL and other control characters, invalid UTF-8, overlong names
+//   - rewritten: characters Windows forbids (<>:"|?*) become '_', trailing dots and spaces are
+//     dropped, and reserved device names (CON, NUL, COM1, LPT1, ...) get a leading '_', so
+//     the same tree lands identically on every OS
+//   - the joined path must stay below the receive root, and no existing element below the
+//     root may be a symlink, so a planted link cannot redirect writes elsewhere
+//   - the <path>.part a file is received into is opened through openPart, which refuses
+//     anything but a regular file and does not follow a link
+
+// sanitizeName validates a single path element and returns its portable form.
+func sanitizeName(name string) (string, error) {
+	if name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("%w: %q", ErrUnsafePath, name)
+	}
+	if len(name) > maxNameLen {
+		return "", fmt.Errorf("%w: name longer than %d bytes", ErrUnsafePath, maxNameLen)
+	}
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("%w: %q is not valid UTF-8", ErrUnsafePath, name)
+	}
+	var sb strings.Builder
+	for _, r := range name {
+		switch {
+		case r == '/' || r == '\\':
+			return "", fmt.Errorf("%w: %q contains a path separator", ErrUnsafePath, name)
+		case r < 0x20 || r == 0x7f:
+			return "", fmt.Errorf("%w: %q contains control characters", ErrUnsafePath, name)
+		case strings.ContainsRune(`<>:"|?*`, r):
+			sb.WriteByte('_')
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	out := strings.TrimRight(sb.String(), ". ")
+	if out == "" {
+		return "", fmt.Errorf("%w: %q", ErrUnsafePath, name)
+	}
+	if isReservedName(out) {
+		out = "_" + out
+	}
+	return out, nil
+}
+
+// isReservedName reports whether name is a Windows device name, with or without extension.
+func isReservedName(name string) bool {
+	base, _, _ := strings.Cut(name, ".")
+	base = strings.ToUpper(strings.TrimRight(base, " "))
+	switch base {
+	case "CON", "PRN", "AUX", "NUL", "CONIN$", "CONOUT$":
+		return true
+	}
+	if len(base) == 4 && (strings.HasPrefix(base, "COM") || strings.HasPrefix(base, "LPT")) {
+		return base[3] >= '0' && base[3] <= '9'
+	}
+	// COM¹, LPT² etc. are reserved as well
+	if r, size := utf8.DecodeLastRuneInString(base); size > 1 && len(base) == 3+size &&
+		(strings.HasPrefix(base, "COM") || strings.HasPrefix(base, "LPT")) {
+		return r == '¹' || r == '²' || r == '³'
+	}
+	return false
+}
+
+// safeRelPath sanitizes a slash-separated relative path from a batch manifest element by
+// element and returns it in OS form.
+func safeRelPath(rel string) (string, error) {
+	if len(rel) > maxPathLen {
+		return "", fmt.Errorf("%w: path longer than %d bytes", ErrUnsafePath, maxPathLen)
+	}
+	if strings.HasPrefix(rel, "/") || strings.Contains(rel, "\\") || filepath.VolumeName(rel) != "" {
+		return "", fmt.Errorf("%w: %q", ErrUnsafePath, rel)
+	}
+	parts := strings.Split(rel, "/")
+	for i, p := range parts {
+		clean, err := sanitizeName(p)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = clean
+	}
+	return filepath.Join(parts...), nil
+}
+
+// safeJoin resolves a sanitized relative path below root. It refuses results outside root
+// and any existing element below root that is a symlink.
+func safeJoin(root, rel string) (string, error) {
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%w: %q escapes the receive directory", ErrUnsafePath, rel)
+	}
+	p := root
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, elem)
+		fi, err := os.Lstat(p)
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%w: %s is a symlink", ErrUnsafePath, p)
+		}
+	}
+	return filepath.Join(root, rel), nil
+}
+
+// openPart opens the .part at tmpPath with flag (os.O_RDONLY, or os.O_WRONLY|os.O_CREATE and
+// more). A symlink there, e.g. one a batch stored under --escaping-links keep, or any other
+// file that is not a regular one is refused, so receiving a file named like it cannot write
+// through it. On Unix the open itself does not follow a link planted after the check.
+func openPart(tmpPath string, flag int) (*os.File, error) {
+	if fi, err := os.Lstat(tmpPath); err == nil && !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: %s is not a regular file", ErrUnsafePath, tmpPath)
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	f, err := os.OpenFile(tmpPath, flag|oNoFollow, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err != nil || !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s is not a regular file", ErrUnsafePath, tmpPath)
+	}
+	return f, nil
+}
@@ -0,0 +1,68 @@
+package transfer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// Hostile seeds (traversal, absolute paths, backslashes, NUL, drive letters, .part names)
+// are under testdata/fuzz; go test -fuzz=FuzzSanitizeName (or FuzzSafeJoin) explores further.
+
+func FuzzSanitizeName(f *testing.F) {
+	f.Add("a.txt")
+	f.Add("CON")
+	f.Add("trailing. .")
+	f.Fuzz(func(t *testing.T, name string) {
+		out, err := sanitizeName(name)
+		if err != nil {
+			return
+		}
+		if out == "" || out == "." || out == ".." || len(out) > maxNameLen+1 {
+			t.Fatalf("sanitizeName(%q) = %q", name, out)
+		}
+		if !utf8.ValidString(out) || strings.ContainsAny(out, `/\<>:"|?*`) || strings.TrimRight(out, ". ") != out {
+			t.Fatalf("sanitizeName(%q) = %q: not portable", name, out)
+		}
+		for _, r := range out {
+			if r < 0x20 || r == 0x7f {
+				t.Fatalf("sanitizeName(%q) = %q: control character", name, out)
+			}
+		}
+		if isReservedName(out) || !filepath.IsLocal(out) {
+			t.Fatalf("sanitizeName(%q) = %q: not a plain local name", name, out)
+		}
+		if again, err := sanitizeName(out); err != nil || again != out {
+			t.Fatalf("sanitizeName(%q) = %q, %v: not stable", out, again, err)
+		}
+	})
+}
+
+func FuzzSafeJoin(f *testing.F) {
+	f.Add("a/b.txt")
+	// A link below the receive root that leads out of it must never be written through
+	root := f.TempDir()
+	outside := f.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		f.Skip("symlinks not available:", err)
+	}
+	f.Fuzz(func(t *testing.T, rel string) {
+		clean, err := safeRelPath(rel)
+		if err != nil {
+			return
+		}
+		p, err := safeJoin(root, clean)
+		if err != nil {
+			return
+		}
+		inside, err := filepath.Rel(root, p)
+		if err != nil || !filepath.IsLocal(inside) {
+			t.Fatalf("safeJoin(%q) = %s: outside the root", rel, p)
+		}
+		if first, _, _ := strings.Cut(inside, string(filepath.Separator)); first == "link" {
+			t.Fatalf("safeJoin(%q) = %s: through a symlink", rel, p)
+		}
+	})
+}
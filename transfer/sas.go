@@ -0,0 +1,133 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrSASRejected is returned when either user says the verification codes do not match.
+var ErrSASRejected = errors.New("verification code rejected")
+
+// Short authentication string (SAS) exchange, run after the identity exchange when
+// Options.ConfirmSAS is set. The receiver commits to a random nonce before seeing the
+// sender's, so a man in the middle cannot grind key shares until both codes collide:
+//
+//	receiver -> sas-commit {sha256(nR)}
+//	sender   -> sas-nonce  {nS}
+//	receiver -> sas-reveal {nR}
+//	both show code(transcript, identities, channel binding, nR, nS) and ask the user
+//	receiver -> sas-result {ok}
+
+type sasCommit struct {
+	Commit []byte `json:"commit"`
+}
+
+type sasNonce struct {
+	Nonce []byte `json:"nonce"`
+}
+
+type sasResult struct {
+	OK bool `json:"ok"`
+}
+
+// exchangeSAS runs the commit/reveal exchange, asks the local user to compare the code and
+// requires the receiver's user to confirm too before the sender proceeds.
+func (s *session) exchangeSAS(opts Options, role string, self PeerIdentity) error {
+	var nR, nS []byte
+	switch role {
+	case "receiver":
+		nR = make([]byte, 32)
+		if _, err := rand.Read(nR); err != nil {
+			return fmt.Errorf("sas nonce: %w", err)
+		}
+		commit := sha256.Sum256(nR)
+		if err := s.writeJSON(sasCommit{Commit: commit[:]}, "sas-commit"); err != nil {
+			return fmt.Errorf("write sas commit: %w", err)
+		}
+		if err := s.flush(); err != nil {
+			return fmt.Errorf("flush sas commit: %w", err)
+		}
+		var peer sasNonce
+		if err := s.readJSON(&peer, "sas-nonce"); err != nil {
+			return fmt.Errorf("read sas nonce: %w", err)
+		}
+		nS = peer.Nonce
+		if err := s.writeJSON(sasNonce{Nonce: nR}, "sas-reveal"); err != nil {
+			return fmt.Errorf("write sas reveal: %w", err)
+		}
+		if err := s.flush(); err != nil {
+			return fmt.Errorf("flush sas reveal: %w", err)
+		}
+	default:
+		var c sasCommit
+		if err := s.readJSON(&c, "sas-commit"); err != nil {
+			return fmt.Errorf("read sas commit: %w", err)
+		}
+		nS = make([]byte, 32)
+		if _, err := rand.Read(nS); err != nil {
+			return fmt.Errorf("sas nonce: %w", err)
+		}
+		if err := s.writeJSON(sasNonce{Nonce: nS}, "sas-nonce"); err != nil {
+			return fmt.Errorf("write sas nonce: %w", err)
+		}
+		if err := s.flush(); err != nil {
+			return fmt.Errorf("flush sas nonce: %w", err)
+		}
+		var reveal sasNonce
+		if err := s.readJSON(&reveal, "sas-reveal"); err != nil {
+			return fmt.Errorf("read sas reveal: %w", err)
+		}
+		sum := sha256.Sum256(reveal.Nonce)
+		if !bytes.Equal(sum[:], c.Commit) {
+			return errors.New("sas reveal does not match commitment")
+		}
+		nR = reveal.Nonce
+	}
+
+	recvID, sendID := self, s.peer
+	if role == "sender" {
+		recvID, sendID = s.peer, self
+	}
+	code := sasCode(s.transcript, recvID.Fingerprint, sendID.Fingerprint, opts.ChannelBinding, nR, nS)
+	ok := opts.ConfirmSAS(s.peer, code)
+
+	if role == "receiver" {
+		if err := s.writeJSON(sasResult{OK: ok}, "sas-result"); err != nil {
+			return fmt.Errorf("write sas result: %w", err)
+		}
+		if err := s.flush(); err != nil {
+			return fmt.Errorf("flush sas result: %w", err)
+		}
+		if !ok {
+			return ErrSASRejected
+		}
+		return nil
+	}
+	if !ok {
+		return ErrSASRejected
+	}
+	var res sasResult
+	if err := s.readJSON(&res, "sas-result"); err != nil {
+		return fmt.Errorf("read sas result: %w", err)
+	}
+	if !res.OK {
+		return fmt.Errorf("%w by %s", ErrSASRejected, s.peer.Name)
+	}
+	return nil
+}
+
+// sasCode renders six decimal digits as "123-456".
+func sasCode(transcript []byte, recvFP, sendFP string, binding, nR, nS []byte) string {
+	h := sha256.New()
+	h.Write([]byte("learnP2P SAS\x00"))
+	for _, part := range [][]byte{transcript, []byte(recvFP), []byte(sendFP), binding, nR, nS} {
+		_ = binary.Write(h, binary.BigEndian, uint32(len(part)))
+		h.Write(part)
+	}
+	v := binary.BigEndian.Uint32(h.Sum(nil)) % 1_000_000
+	return fmt.Sprintf("%03d-%03d", v/1000, v%1000)
+}
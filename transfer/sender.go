@@ -1,169 +1,327 @@
 package transfer
 
 import (
-	"bufio"
-	"crypto/rand"
-	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"os"
-	"time"
-
-	pcrypto "learnP2P/crypto"
+	"path/filepath"
+	"sync"
 )
 
 const ChunkSize = 1 << 20 // 1MB
 
-// Send streams the file with AES-GCM encryption.
+// Send streams the file (or, for a directory, every file below it) with AES-GCM encryption.
 // Protocol (single workflow, no legacy):
-// 1) Receiver sends: 0x01 | uint32(pubLen) | pubDER (RSA-4096 PKIX)
-// 2) Sender replies: 0x02 | uint32(encKeyLen) | encKey(RSA-OAEP of AES key) | baseNonce(12)
-// 3) Sender sends: uint32(len(cman)) | cman (GCM over manifest, AAD="manifest")
-// 4) Sender streams chunks: [ uint32(len(ct)) | ct ]* using AAD=sha256(manifest.data)
-func Send(conn net.Conn, filePath string) error {
+// 1) Receiver sends: 0x03 | pub(32) (ephemeral X25519 key share)
+// 2) Sender replies: 0x03 | pub(32); both derive the AES key and baseNonce(12) via HKDF-SHA256
+// Both sides then exchange Ed25519-signed identities (AAD="identity"), receiver first
+// 3) Sender sends: uint32(len(coffer)) | coffer (GCM over {type, file|batch, compression}, AAD="manifest")
+// The receiver answers {accept, reason, compression} (AAD="offer-reply"); a decline ends the transfer with ErrDeclined
+// Then for the file, or for each file of a batch in manifest order:
+// 4) Receiver sends: resume request {need: chunk ranges its .part lacks, conflict outcome}
+// (AAD="resume"); sender answers, splitting the ranges across streams when the receiver
+// offered extra ones (parallel.go)
+// 5) Sender streams the needed chunks: [ uint32(len(ct)) | ct ]* using AAD=sha256(manifest.data);
+// with compression each plaintext is flag(1) | deflate or raw bytes. The receiver checks each
+// chunk against the manifest's chunk hashes. When the request carried block signatures of an
+// older copy, the reply may instead list copies from it and only the rest is streamed (delta.go)
+// 6) Receiver sends the file receipt {done, ok, hash, stored | reason, retry} (AAD="receipt"), optionally
+// preceded by interim acks; on retry the file goes back to step 4 for the chunks still missing
+// A batch ends with the receiver's summary (AAD="summary").
+// Either side may abort instead of sending its next message (see cancel.go).
+func Send(conn net.Conn, filePath string, opts Options) error {
+	st, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		return sendBatch(conn, filePath, opts)
+	}
+
 	// Build manifest
 	man, err := BuildManifest(filePath)
 	if err != nil {
 		return fmt.Errorf("build manifest: %w", err)
 	}
-
-	br := bufio.NewReader(conn)
-	bw := bufio.NewWriter(conn)
-
-	// 1) Read receiver's RSA public key message
-	msgType, err := br.ReadByte()
+	s, err := openSenderSession(conn, opts)
 	if err != nil {
-		return fmt.Errorf("read receiver pubkey: %w", err)
-	}
-	if msgType != 0x01 {
-		return fmt.Errorf("unexpected receiver message type: 0x%02x", msgType)
-	}
-	var pkLen uint32
-	if err := binary.Read(br, binary.BigEndian, &pkLen); err != nil {
-		return fmt.Errorf("read pubkey len: %w", err)
+		return err
 	}
-	if pkLen == 0 || pkLen > 1_000_000 {
-		return fmt.Errorf("invalid pubkey length: %d", pkLen)
+	if err := s.writeJSON(offer{Type: offerFile, File: &man, Compression: opts.compressionOffer()}, "manifest"); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
 	}
-	pkDER := make([]byte, pkLen)
-	if _, err := io.ReadFull(br, pkDER); err != nil {
-		return fmt.Errorf("read pubkey der: %w", err)
+	if err := s.flush(); err != nil {
+		return fmt.Errorf("flush manifest: %w", err)
 	}
-	pub, err := pcrypto.ParsePublicKeyDER(pkDER)
-	if err != nil {
-		return fmt.Errorf("parse pubkey: %w", err)
+	if err := s.awaitAcceptance(); err != nil {
+		return err
 	}
+	return sendFile(s, filePath, man, opts)
+}
 
-	// 2) Create session key + base nonce, encrypt key with RSA-OAEP and send header v0x02
-	key, err := pcrypto.GenerateKey()
+// sendBatch walks root, sends the batch manifest and then every file under the same session key.
+func sendBatch(conn net.Conn, root string, opts Options) error {
+	b, err := BuildBatchManifest(root, opts.escapingLinks())
 	if err != nil {
-		return fmt.Errorf("gen key: %w", err)
+		return fmt.Errorf("build batch manifest: %w", err)
 	}
-	aead, err := pcrypto.NewGCM(key)
+	s, err := openSenderSession(conn, opts)
 	if err != nil {
-		return fmt.Errorf("gcm: %w", err)
+		return err
 	}
-	base := make([]byte, pcrypto.NonceSize)
-	if _, err := rand.Read(base); err != nil {
-		return fmt.Errorf("nonce: %w", err)
+	if err := s.writeJSON(offer{Type: offerBatch, Batch: &b, Compression: opts.compressionOffer()}, "manifest"); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
 	}
-	encKey, err := pcrypto.EncryptKeyRSAOAEP(pub, key)
-	if err != nil {
-		return fmt.Errorf("rsa-oaep encrypt: %w", err)
+	if err := s.flush(); err != nil {
+		return fmt.Errorf("flush manifest: %w", err)
 	}
-	if err := bw.WriteByte(0x02); err != nil { // header version
+	if err := s.awaitAcceptance(); err != nil {
 		return err
 	}
-	if err := binary.Write(bw, binary.BigEndian, uint32(len(encKey))); err != nil {
-		return fmt.Errorf("write encKey len: %w", err)
+	return sendBatchFiles(s, root, b, opts)
+}
+
+// sendBatchFiles sends every file of the accepted batch b read from root, then reads the
+// receiver's summary.
+func sendBatchFiles(s *session, root string, b BatchManifest, opts Options) error {
+	Printf("Sending %s: %d file(s), %d dir(s), %s\n", b.Root, len(b.Files), len(b.Dirs), humanBytes(b.Size))
+	for _, m := range b.Files {
+		err := sendFile(s, filepath.Join(root, filepath.FromSlash(m.Name)), m, opts)
+		var fe *fileError
+		if errors.As(err, &fe) {
+			Printf("Skipped %s: %v\n", m.Name, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("send %s: %w", m.Name, err)
+		}
 	}
-	if _, err := bw.Write(encKey); err != nil {
-		return fmt.Errorf("write encKey: %w", err)
+	var sum BatchSummary
+	if err := s.readJSON(&sum, "summary"); err != nil {
+		return fmt.Errorf("read batch summary: %w", err)
 	}
-	if _, err := bw.Write(base); err != nil {
-		return fmt.Errorf("write base nonce: %w", err)
+	Printf("%s\n", sum.Pretty())
+	return nil
+}
+
+// sendFile negotiates the resume offset for one file, streams its chunks and waits for the
+// receiver's receipt. A file that fails the receiver's integrity check is sent again, up to
+// maxAttempts times in total.
+func sendFile(s *session, filePath string, man Manifest, opts Options) error {
+	f, ferr := os.Open(filePath)
+	if ferr == nil {
+		defer f.Close()
 	}
-	if err := bw.Flush(); err != nil {
-		return fmt.Errorf("flush header: %w", err)
+	for {
+		rcpt, err := sendAttempt(s, f, ferr, man, opts)
+		if err != nil || rcpt == nil {
+			return err
+		}
+		if rcpt.OK {
+			Printf("Delivered %s: receiver verified SHA-256 and stored it as %s\n", man.Name, rcpt.Stored)
+			return nil
+		}
+		if !rcpt.Retry {
+			return &fileError{fmt.Errorf("receiver could not store file: %s", rcpt.Reason)}
+		}
+		Printf("%s: %s; sending again\n", man.Name, rcpt.Reason)
 	}
+}
 
-	// nonce counter in last 4 bytes (big endian)
-	var ctr uint32
-	nonceFor := func() []byte {
-		n := make([]byte, len(base))
-		copy(n, base)
-		i := len(n) - 4
-		n[i+0] = byte(ctr >> 24)
-		n[i+1] = byte(ctr >> 16)
-		n[i+2] = byte(ctr >> 8)
-		n[i+3] = byte(ctr)
-		ctr++
-		return n
+// sendAttempt runs one resume negotiation and stream for f. It returns the final receipt,
+// or nil when nothing was streamed because the receiver already holds an identical copy.
+func sendAttempt(s *session, f *os.File, ferr error, man Manifest, opts Options) (*fileReceipt, error) {
+	// Resume negotiation: the receiver lists the chunk ranges it still needs
+	var req resumeRequest
+	if err := s.readJSON(&req, "resume"); err != nil {
+		return nil, fmt.Errorf("read resume request: %w", err)
 	}
-
-	// 3) Encrypted manifest
-	manBytes, _ := json.Marshal(man)
-	cman := aead.Seal(nil, nonceFor(), manBytes, []byte("manifest"))
-	if err := binary.Write(bw, binary.BigEndian, uint32(len(cman))); err != nil {
-		return fmt.Errorf("write manifest len: %w", err)
+	switch {
+	case req.Conflict == conflictIdentical:
+		Printf("%s: receiver already has an identical copy, nothing to send\n", man.Name)
+		return nil, nil
+	case req.Skip:
+		return nil, &fileError{fmt.Errorf("receiver skipped file: %s", req.Reason)}
 	}
-	if _, err := bw.Write(cman); err != nil {
-		return fmt.Errorf("write manifest: %w", err)
+	announceConflict(man.Name, req)
+	if ferr == nil && (!validNeed(req.Need, man.Size) || req.Delta != nil && !req.Delta.valid()) {
+		ferr = errors.New("invalid resume request")
 	}
-	if err := bw.Flush(); err != nil {
-		return fmt.Errorf("flush manifest: %w", err)
+	if ferr != nil {
+		if err := s.writeJSON(resumeReply{Skip: true, Reason: ferr.Error()}, "resume"); err != nil {
+			return nil, fmt.Errorf("write resume reply: %w", err)
+		}
+		if err := s.flush(); err != nil {
+			return nil, fmt.Errorf("flush resume reply: %w", err)
+		}
+		return nil, &fileError{ferr}
 	}
+	remaining := rangesLen(req.Need)
 
-	// 4) Send file data in 1MB chunks with progress
-	f, err := os.Open(filePath)
-	if err != nil {
-		return err
+	// A receiver with an older copy gets copy instructions and only the bytes that changed
+	var plan *deltaPlan
+	if req.Delta != nil && remaining == man.Size {
+		copies, err := computeDelta(f, man.Size, req.Delta)
+		if err != nil {
+			Printf("%s: delta scan failed, sending the whole file: %v\n", man.Name, err)
+		} else if len(copies) > 0 {
+			plan = &deltaPlan{Copies: copies}
+		}
+	}
+	send := req.Need
+	if plan != nil {
+		send = deltaLiterals(plan.Copies, man.Size)
+		remaining = rangesLen(send)
+	}
+
+	// Large files go over several streams when both sides allow it
+	var extras []*session
+	var split [][]byteRange
+	if n := streamCount(opts.Streams, req.Streams, remaining); plan == nil && n > 1 && opts.OpenStream != nil && req.Token != "" {
+		extras = s.openStreams(opts, req.Token, n)
+		if len(extras) > 0 {
+			split = splitNeed(req.Need, len(extras)+1)
+		}
+	}
+	if err := s.writeJSON(resumeReply{Streams: split, Delta: plan}, "resume"); err != nil {
+		closeStreams(extras)
+		return nil, fmt.Errorf("write resume reply: %w", err)
+	}
+	if plan != nil {
+		Printf("Delta %s: receiver reuses %s of its copy, sending %s\n", man.Name, humanBytes(man.Size-remaining), humanBytes(remaining))
+	} else if have := man.Size - remaining; have > 0 && man.Holes != nil {
+		Printf("Sparse %s: sending %s, holes and chunks the receiver has are skipped\n", man.Name, humanBytes(remaining))
+	} else if have > 0 {
+		Printf("Resuming %s: receiver already has %s verified, sending %s\n", man.Name, humanBytes(have), humanBytes(remaining))
 	}
-	defer f.Close()
 
+	// Send file data in 1MB chunks with progress
 	// AAD for chunks = manifest hash bytes
 	hashBytes, derr := hex.DecodeString(man.Hash)
 	if derr != nil {
-		return fmt.Errorf("decode hash: %w", derr)
+		closeStreams(extras)
+		return nil, fmt.Errorf("decode hash: %w", derr)
 	}
 
+	prog := startProgress("Sending", man.Name, man.Size-remaining, man.Size)
+	defer prog.finish()
+	// With acks the receiver reports progress while chunks are still going out, so its
+	// receipts are read concurrently and drive the progress bar; otherwise only the final
+	// receipt follows the last chunk.
+	type result struct {
+		r   fileReceipt
+		err error
+	}
+	var acks chan result
+	if req.AckEvery > 0 {
+		acks = make(chan result, 1)
+		go func() {
+			r, err := s.readReceipt(prog)
+			acks <- result{r, err}
+		}()
+	}
+	// A receiver that cancels closes the connection right behind its abort
+	streamFailed := func(err error) error {
+		var wf *writeFailure
+		switch {
+		case !errors.As(err, &wf):
+			return err
+		case acks == nil:
+			return s.pendingAbort(err)
+		}
+		if res := <-acks; errors.Is(res.err, ErrAborted) {
+			return res.err
+		}
+		return err
+	}
+
+	if split == nil {
+		counted := prog
+		if acks != nil {
+			counted = nil
+		}
+		if err := sendRanges(s, f, send, hashBytes, counted); err != nil {
+			return nil, streamFailed(err)
+		}
+	} else {
+		Printf("Sending %s over %d streams\n", man.Name, len(split))
+		var wg sync.WaitGroup
+		for i, es := range extras {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := sendExtra(es, f, split[i+1], hashBytes, prog); err != nil {
+					Printf("Parallel stream %d: %v\n", i+1, err)
+				}
+			}()
+		}
+		err := sendRanges(s, f, split[0], hashBytes, prog)
+		if err != nil {
+			// Without the control stream the extra streams are of no use
+			closeStreams(extras)
+		}
+		// The receipt on the control stream is authoritative; stream errors show up there.
+		wg.Wait()
+		if err != nil {
+			return nil, streamFailed(err)
+		}
+	}
+
+	var res result
+	if acks != nil {
+		res = <-acks
+	} else {
+		res.r, res.err = s.readReceipt(prog)
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	prog.update(res.r.Received)
+	// Final progress line
+	prog.finish()
+	return &res.r, nil
+}
+
+// announceConflict reports how the receiver handled a name that was already taken.
+func announceConflict(name string, req resumeRequest) {
+	switch req.Conflict {
+	case conflictRenamed:
+		Printf("%s: name taken on the receiver, stored as %s\n", name, req.Stored)
+	case conflictOverwritten:
+		Printf("%s: receiver overwrites its existing copy\n", name)
+	}
+}
+
+// sendRanges streams ranges of f in order as chunks sealed with aad, one frame per chunk.
+// Needed ranges are chunk-aligned, so every frame is exactly one of the manifest's chunks; the
+// uncovered ranges of a delta transfer are cut into frames of at most ChunkSize the same way.
+func sendRanges(s *session, f *os.File, ranges []byteRange, aad []byte, prog *progress) error {
 	buf := make([]byte, ChunkSize)
-	var sent int64
-	start := time.Now()
-	lastTick := time.Time{}
-	for {
-		n, rerr := f.Read(buf)
-		if n > 0 {
-			// Encrypt with AAD = manifest hash
-			ct := aead.Seal(nil, nonceFor(), buf[:n], hashBytes)
-			if err := binary.Write(bw, binary.BigEndian, uint32(len(ct))); err != nil {
-				return fmt.Errorf("write chunk len: %w", err)
+	for _, r := range ranges {
+		for off := r.Offset; off < r.Offset+r.Length; {
+			n, err := f.ReadAt(buf[:min(ChunkSize, r.Offset+r.Length-off)], off)
+			if err != nil {
+				// The receiver expects exactly these bytes; a short file cannot be recovered mid-stream.
+				return fmt.Errorf("read file: %w", err)
 			}
-			if _, werr := bw.Write(ct); werr != nil {
-				return fmt.Errorf("write chunk: %w", werr)
+			// Compress (if negotiated), then encrypt with AAD = manifest hash
+			pt, err := s.codec.encode(buf[:n])
+			if err != nil {
+				return fmt.Errorf("compress chunk: %w", err)
 			}
-			sent += int64(n)
-			now := time.Now()
-			if lastTick.IsZero() || now.Sub(lastTick) >= 200*time.Millisecond {
-				printProgress("Sending", man.Name, sent, man.Size, start)
-				lastTick = now
+			if err := s.writeFrame(pt, aad); err != nil {
+				return &writeFailure{fmt.Errorf("write chunk: %w", err)}
 			}
-		}
-		if rerr == io.EOF {
-			if err := bw.Flush(); err != nil {
-				return fmt.Errorf("flush chunks: %w", err)
+			off += int64(n)
+			if prog != nil {
+				prog.add(int64(n))
 			}
-			// Final progress line
-			printProgress("Sending", man.Name, man.Size, man.Size, start)
-			fmt.Print("\n")
-			break
-		}
-		if rerr != nil {
-			return fmt.Errorf("read file: %w", rerr)
 		}
 	}
+	if err := s.flush(); err != nil {
+		return &writeFailure{fmt.Errorf("flush chunks: %w", err)}
+	}
 	return nil
 }
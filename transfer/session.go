@@ -0,0 +1,254 @@
+package transfer
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	pcrypto "learnP2P/crypto"
+)
+
+// session is an established encrypted link: one AES-256-GCM key and a nonce sequence per direction.
+type session struct {
+	br   *bufio.Reader
+	bw   *bufio.Writer
+	aead cipher.AEAD
+	tx   *nonceSeq
+	rx   *nonceSeq
+
+	transcript []byte       // receiver key share || sender key share
+	peer       PeerIdentity // set once exchangeIdentity succeeds
+	codec      *chunkCodec  // chunk compression, set once the offer is accepted
+	conn       net.Conn     // extra parallel streams only: closed once their range is confirmed
+	verified   bool         // the peer proved the password (see authKeyer) or passed the SAS
+
+	// wmu keeps whole frames together, so an abort (see cancel.go) can be written from
+	// another goroutine; once it is sent, nothing else is.
+	wmu     sync.Mutex
+	aborted bool
+}
+
+// writeFrame seals pt with the next outgoing nonce. Call flush to push it to the peer.
+func (s *session) writeFrame(pt, aad []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.aborted {
+		return errAbortSent
+	}
+	return writeSealed(s.bw, s.aead, s.tx.next(), pt, aad)
+}
+
+// readFrame reads and opens the next incoming frame. A frame the peer sealed as an abort
+// instead is returned as ErrAborted with the peer's reason.
+func (s *session) readFrame(aad []byte) ([]byte, error) {
+	ct, err := readCiphertext(s.br)
+	if err != nil {
+		return nil, err
+	}
+	nonce := s.rx.next()
+	pt, err := s.aead.Open(nil, nonce, ct, aad)
+	if err != nil {
+		if b, aerr := s.aead.Open(nil, nonce, ct, abortAAD); aerr == nil {
+			return nil, s.peerAborted(b)
+		}
+		return nil, err
+	}
+	return pt, nil
+}
+
+// writeJSON seals the JSON encoding of v as one frame.
+func (s *session) writeJSON(v any, aad string) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.writeFrame(b, []byte(aad))
+}
+
+// peerText is implemented by messages that carry free-form text from the peer, such as the
+// reason a file failed. printable drops control characters from it (see printableText), so
+// the text can be shown on a terminal as it is.
+type peerText interface {
+	printable()
+}
+
+// readJSON opens the next frame and decodes it into v.
+func (s *session) readJSON(v any, aad string) error {
+	b, err := s.readFrame([]byte(aad))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return err
+	}
+	if t, ok := v.(peerText); ok {
+		t.printable()
+	}
+	return nil
+}
+
+func (s *session) flush() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.aborted {
+		return errAbortSent
+	}
+	return s.bw.Flush()
+}
+
+// Handshake message tags. 0x01 and 0x02 were the RSA-OAEP exchange (receiver public key,
+// then sender key header); 0x03 is the ephemeral X25519 key share both sides send.
+const (
+	tagRSAPublicKey byte = 0x01
+	tagRSAKeyHeader byte = 0x02
+	tagKeyShare     byte = 0x03
+)
+
+// sessionInfo is the HKDF info string for session keys.
+const sessionInfo = "learnP2P/3 session"
+
+// authKeyer is implemented by connections that completed a password-authenticated key
+// exchange (connections.AuthConn). The key is mixed into the session key derivation, so
+// a man in the middle who did not take part in that exchange cannot splice in.
+type authKeyer interface {
+	AuthKey() []byte
+}
+
+func authKey(conn net.Conn) []byte {
+	if ak, ok := conn.(authKeyer); ok {
+		return ak.AuthKey()
+	}
+	return nil
+}
+
+// ErrVersionMismatch is returned when the peer only speaks an older handshake version.
+var ErrVersionMismatch = errors.New("protocol version mismatch")
+
+// openSenderSession runs the sender side of the key exchange:
+// read the receiver's ephemeral X25519 share, answer with our own and derive the session key,
+// then exchange signed identities.
+func openSenderSession(conn net.Conn, opts Options) (*session, error) {
+	br := bufio.NewReader(conn)
+	bw := bufio.NewWriter(conn)
+
+	// 1) Read receiver's key share
+	peerPub, err := readKeyShare(br)
+	if err != nil {
+		return nil, fmt.Errorf("read receiver key share: %w", err)
+	}
+
+	// 2) Reply with a fresh ephemeral key share
+	priv, err := pcrypto.GenerateX25519()
+	if err != nil {
+		return nil, fmt.Errorf("gen x25519 key: %w", err)
+	}
+	if err := writeKeyShare(bw, priv.PublicKey().Bytes()); err != nil {
+		return nil, fmt.Errorf("write key share: %w", err)
+	}
+	s, err := newSession(br, bw, priv, peerPub, authKey(conn), peerPub, priv.PublicKey().Bytes(), dirSender, dirReceiver)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.exchangeIdentity(opts, "sender"); err != nil {
+		return nil, err
+	}
+	opts.cancel.attach(s, conn)
+	return s, nil
+}
+
+// openReceiverSession runs the receiver side of the key exchange:
+// send our ephemeral X25519 share first, then read the sender's and derive the session key,
+// then exchange signed identities.
+func openReceiverSession(conn net.Conn, opts Options) (*session, error) {
+	br := bufio.NewReader(conn)
+	bw := bufio.NewWriter(conn)
+
+	// 0) Send our key share first: 0x03 | pub(32)
+	priv, err := pcrypto.GenerateX25519()
+	if err != nil {
+		return nil, fmt.Errorf("gen x25519 key: %w", err)
+	}
+	if err := writeKeyShare(bw, priv.PublicKey().Bytes()); err != nil {
+		return nil, fmt.Errorf("write key share: %w", err)
+	}
+
+	// 1) Read the sender's key share
+	peerPub, err := readKeyShare(br)
+	if err != nil {
+		return nil, fmt.Errorf("read sender key share: %w", err)
+	}
+	s, err := newSession(br, bw, priv, peerPub, authKey(conn), priv.PublicKey().Bytes(), peerPub, dirReceiver, dirSender)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.exchangeIdentity(opts, "receiver"); err != nil {
+		return nil, err
+	}
+	opts.cancel.attach(s, conn)
+	return s, nil
+}
+
+// newSession derives the AES-256-GCM key and base nonce via HKDF over the X25519 secret
+// (plus psk, if any), salted with both public keys (receiver's first).
+func newSession(br *bufio.Reader, bw *bufio.Writer, priv *ecdh.PrivateKey, peerPub, psk, recvPub, sendPub []byte, txDir, rxDir byte) (*session, error) {
+	peer, err := pcrypto.ParseX25519PublicKey(peerPub)
+	if err != nil {
+		return nil, fmt.Errorf("parse key share: %w", err)
+	}
+	salt := append(append([]byte{}, recvPub...), sendPub...)
+	key, base, err := pcrypto.DeriveSessionKey(priv, peer, psk, salt, sessionInfo)
+	if err != nil {
+		return nil, fmt.Errorf("derive session key: %w", err)
+	}
+	aead, err := pcrypto.NewGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &session{
+		br:         br,
+		bw:         bw,
+		aead:       aead,
+		tx:         newNonceSeq(base, txDir),
+		rx:         newNonceSeq(base, rxDir),
+		transcript: salt,
+		verified:   len(psk) > 0,
+	}, nil
+}
+
+// writeKeyShare writes 0x03 | pub(32) and flushes.
+func writeKeyShare(bw *bufio.Writer, pub []byte) error {
+	if err := bw.WriteByte(tagKeyShare); err != nil {
+		return err
+	}
+	if _, err := bw.Write(pub); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// readKeyShare reads a 0x03 key share; the RSA-era tags produce ErrVersionMismatch.
+func readKeyShare(br *bufio.Reader) ([]byte, error) {
+	tag, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case tagKeyShare:
+	case tagRSAPublicKey, tagRSAKeyHeader:
+		return nil, fmt.Errorf("%w: peer sent header 0x%02x (RSA-OAEP), this node requires 0x%02x (X25519)",
+			ErrVersionMismatch, tag, tagKeyShare)
+	default:
+		return nil, fmt.Errorf("unexpected handshake message type: 0x%02x", tag)
+	}
+	pub := make([]byte, pcrypto.X25519KeySize)
+	if _, err := io.ReadFull(br, pub); err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
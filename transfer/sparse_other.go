@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package transfer
+
+import "os"
+
+// fileHoles reports no holes where SEEK_HOLE is not available; sparse files are sent in full.
+func fileHoles(f *os.File, size int64) []byteRange {
+	return nil
+}
@@ -0,0 +1,39 @@
+//go:build linux || darwin || freebsd
+
+package transfer
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileHoles returns the holes of a sparse file found with SEEK_DATA and SEEK_HOLE, skipping
+// those too small to contain a whole chunk. A file system without hole support reports the
+// whole file as data. f is rewound to the start.
+func fileHoles(f *os.File, size int64) []byteRange {
+	defer f.Seek(0, io.SeekStart)
+	var holes []byteRange
+	for off := int64(0); off < size; {
+		data, err := f.Seek(off, unix.SEEK_DATA)
+		if err != nil {
+			// ENXIO: no data after off; anything else: no usable hole information
+			if !errors.Is(err, unix.ENXIO) {
+				return nil
+			}
+			data = size
+		}
+		if data-off >= ChunkSize {
+			holes = append(holes, byteRange{Offset: off, Length: min(data, size) - off})
+		}
+		if data >= size {
+			break
+		}
+		if off, err = f.Seek(data, unix.SEEK_HOLE); err != nil {
+			return nil
+		}
+	}
+	return holes
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package transfer
+
+import "io/fs"
+
+// oNoFollow is not available; openPart relies on its Lstat check alone.
+const oNoFollow = 0
+
+// fileOwner reports no owner on systems without numeric user ids.
+func fileOwner(fi fs.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// fileID reports no identity, so hard links are sent as separate files.
+func fileID(fi fs.FileInfo) (id inode, links uint64, ok bool) {
+	return inode{}, 0, false
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package transfer
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// oNoFollow makes opening a symlink fail instead of opening its target.
+const oNoFollow = syscall.O_NOFOLLOW
+
+// fileOwner returns the numeric owner and group of fi.
+func fileOwner(fi fs.FileInfo) (uid, gid int, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// fileID identifies the file behind fi and reports how many names it has.
+func fileID(fi fs.FileInfo) (id inode, links uint64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return inode{}, 0, false
+	}
+	return inode{dev: uint64(st.Dev), ino: uint64(st.Ino)}, uint64(st.Nlink), true
+}
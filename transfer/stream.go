@@ -0,0 +1,319 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// Streamed files. A pipe (tar, pg_dump, ...) cannot be hashed before it is sent, so its
+// manifest declares SizeUnknown and carries no hashes:
+//
+//	sender   -> offer {type: "file", file: {name, size: -1}}; the receiver accepts or declines
+//	receiver -> resume request {conflict, stored} (or skip), no ranges: a stream cannot resume
+//	sender   -> chunks of at most ChunkSize as the input yields them (AAD="stream"), then an
+//	            empty chunk
+//	sender   -> trailer {size, hash} (AAD="trailer"), or {error} if the input failed
+//	receiver -> file receipt, after comparing the trailer with what it received
+//
+// A streamed file is never retried: the sender cannot read its input twice.
+
+// SizeUnknown is the manifest size of a streamed file.
+const SizeUnknown = -1
+
+var streamAAD = []byte("stream")
+
+// streamTrailer follows the last chunk of a streamed file.
+type streamTrailer struct {
+	Size  int64  `json:"size"`
+	Hash  string `json:"hash"`
+	Error string `json:"error,omitempty"` // the input failed; the data is incomplete
+}
+
+func (t *streamTrailer) printable() { t.Error = printableText(t.Error) }
+
+// SendStream sends everything read from r as one file called name, without knowing its size
+// in advance. The SHA-256 is computed on the way and sent after the last chunk.
+func SendStream(conn net.Conn, name string, r io.Reader, opts Options) error {
+	man := Manifest{Name: name, Size: SizeUnknown}
+	s, err := openSenderSession(conn, opts)
+	if err != nil {
+		return err
+	}
+	if err := s.writeJSON(offer{Type: offerFile, File: &man, Compression: opts.compressionOffer()}, "manifest"); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	if err := s.flush(); err != nil {
+		return fmt.Errorf("flush manifest: %w", err)
+	}
+	if err := s.awaitAcceptance(); err != nil {
+		return err
+	}
+	var req resumeRequest
+	if err := s.readJSON(&req, "resume"); err != nil {
+		return fmt.Errorf("read resume request: %w", err)
+	}
+	if req.Skip {
+		return fmt.Errorf("receiver skipped file: %s", req.Reason)
+	}
+	announceConflict(name, req)
+
+	prog := startProgress("Sending", name, 0, SizeUnknown)
+	defer prog.finish()
+	h := sha256.New()
+	tr := streamTrailer{}
+	buf := make([]byte, ChunkSize)
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			pt, err := s.codec.encode(buf[:n])
+			if err != nil {
+				return fmt.Errorf("compress chunk: %w", err)
+			}
+			if err := s.writeFrame(pt, streamAAD); err != nil {
+				return s.pendingAbort(fmt.Errorf("write chunk: %w", err))
+			}
+			tr.Size += int64(n)
+			prog.add(int64(n))
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			// The receiver learns from the trailer that the data is incomplete
+			tr.Error = rerr.Error()
+			break
+		}
+	}
+	tr.Hash = hex.EncodeToString(h.Sum(nil))
+	end, err := s.codec.encode(nil)
+	if err != nil {
+		return fmt.Errorf("compress chunk: %w", err)
+	}
+	if err := s.writeFrame(end, streamAAD); err != nil {
+		return s.pendingAbort(fmt.Errorf("write end of stream: %w", err))
+	}
+	if err := s.writeJSON(tr, "trailer"); err != nil {
+		return s.pendingAbort(fmt.Errorf("write trailer: %w", err))
+	}
+	if err := s.flush(); err != nil {
+		return s.pendingAbort(fmt.Errorf("flush stream: %w", err))
+	}
+	rcpt, err := s.readReceipt(prog)
+	if err != nil {
+		return err
+	}
+	prog.finish()
+	if tr.Error != "" {
+		return fmt.Errorf("read input: %s", tr.Error)
+	}
+	if !rcpt.OK {
+		return fmt.Errorf("receiver could not store stream: %s", rcpt.Reason)
+	}
+	Printf("Delivered %s (%s): receiver verified SHA-256 and stored it as %s\n", name, humanBytes(tr.Size), rcpt.Stored)
+	return nil
+}
+
+// receiveStream receives a streamed file into <outPath>.part and renames it into place once
+// the trailer's size and hash match. The conflict policy applies as for any file.
+func receiveStream(s *session, man Manifest, outPath string, opts Options) (Manifest, string, error) {
+	outPath, conflict, err := placeFile(outPath, man, opts.conflictPolicy())
+	if err != nil {
+		return Manifest{}, "", skipFile(s, err)
+	}
+	defer releasePath(outPath + ".part")
+	tmpPath := outPath + ".part"
+	out, err := openPart(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+	if err != nil {
+		return Manifest{}, "", skipFile(s, fmt.Errorf("create file: %w", err))
+	}
+	defer out.Close()
+	req := resumeRequest{Conflict: conflict}
+	if conflict != "" {
+		req.Stored = filepath.Base(outPath)
+	}
+	if err := s.sendResume(req); err != nil {
+		return Manifest{}, "", err
+	}
+
+	r, tr, err := receiveStreamData(s, man.Name, out)
+	if err != nil {
+		out.Close()
+		opts.dropPartial(tmpPath, err)
+		return Manifest{}, "", err
+	}
+	if r.Reason == "" && opts.cancel.canceled() {
+		out.Close()
+		err := opts.cancel.err()
+		opts.dropPartial(tmpPath, err)
+		return Manifest{}, "", err
+	}
+	if r.Reason == "" {
+		if err := out.Close(); err != nil {
+			r.Reason = fmt.Sprintf("close output: %v", err)
+		} else if err := os.Rename(tmpPath, outPath); err != nil {
+			r.Reason = fmt.Sprintf("finalize file: %v", err)
+		}
+	}
+	if r.Reason != "" {
+		_ = os.Remove(tmpPath)
+	} else {
+		r.OK = true
+		r.Stored = filepath.ToSlash(outPath)
+	}
+	if err := s.writeReceipt(r); err != nil {
+		return Manifest{}, "", err
+	}
+	if !r.OK {
+		return Manifest{}, "", &fileError{errors.New(r.Reason)}
+	}
+	man.Size, man.Hash = tr.Size, tr.Hash
+	return man, outPath, nil
+}
+
+// receiveToOutput receives a single file, streamed or not, into opts.Output in order.
+// Nothing can be requested twice, so chunks are never retried.
+func receiveToOutput(s *session, man Manifest, opts Options) (Manifest, string, error) {
+	const stored = "(output stream)"
+	var r fileReceipt
+	if man.Size == SizeUnknown {
+		if err := s.sendResume(resumeRequest{}); err != nil {
+			return Manifest{}, "", err
+		}
+		var tr streamTrailer
+		var err error
+		if r, tr, err = receiveStreamData(s, man.Name, opts.Output); err != nil {
+			return Manifest{}, "", err
+		}
+		man.Size, man.Hash = tr.Size, tr.Hash
+	} else {
+		if err := man.checkChunks(); err != nil {
+			return Manifest{}, "", skipFile(s, err)
+		}
+		hashBytes, err := hex.DecodeString(man.Hash)
+		if err != nil {
+			return Manifest{}, "", fmt.Errorf("decode hash: %w", err)
+		}
+		var need []byteRange
+		if man.Size > 0 {
+			need = []byteRange{{Offset: 0, Length: man.Size}}
+		}
+		if err := s.sendResume(resumeRequest{Need: need}); err != nil {
+			return Manifest{}, "", err
+		}
+		var rep resumeReply
+		if err := s.readJSON(&rep, "resume"); err != nil {
+			return Manifest{}, "", fmt.Errorf("read resume reply: %w", err)
+		}
+		if rep.Skip {
+			return Manifest{}, "", &fileError{fmt.Errorf("sender skipped file: %s", rep.Reason)}
+		}
+		if len(rep.Streams) > 0 || rep.Delta != nil {
+			return Manifest{}, "", errors.New("unexpected resume reply")
+		}
+		w := &orderedWriter{w: opts.Output, h: sha256.New()}
+		prog := startProgress("Receiving", man.Name, 0, man.Size)
+		defer prog.finish()
+		bad, werr, err := receiveChunks(s, man, w, need, hashBytes, func(n int64) error {
+			prog.add(n)
+			return nil
+		})
+		if err != nil {
+			return Manifest{}, "", err
+		}
+		prog.finish()
+		r = fileReceipt{Received: w.off, Done: true, Hash: hex.EncodeToString(w.h.Sum(nil))}
+		switch {
+		case bad > 0:
+			r.Reason = fmt.Sprintf("%d chunk(s) failed verification", bad)
+		case werr != nil:
+			r.Reason = fmt.Sprintf("write output: %v", werr)
+		case r.Hash != man.Hash:
+			r.Reason = fmt.Sprintf("hash mismatch: got %s, expected %s", r.Hash, man.Hash)
+		}
+	}
+	if r.Reason == "" {
+		r.OK, r.Stored = true, stored
+	}
+	if err := s.writeReceipt(r); err != nil {
+		return Manifest{}, "", err
+	}
+	if !r.OK {
+		return Manifest{}, "", &fileError{errors.New(r.Reason)}
+	}
+	return man, stored, nil
+}
+
+// receiveStreamData copies stream chunks into w until the empty chunk, then reads the
+// trailer and checks it. The returned receipt is final; a Reason means the data is not valid.
+// A local write error does not end the stream: the rest is drained and reported.
+func receiveStreamData(s *session, name string, w io.Writer) (fileReceipt, streamTrailer, error) {
+	prog := startProgress("Receiving", name, 0, SizeUnknown)
+	defer prog.finish()
+	h := sha256.New()
+	var n int64
+	var werr error
+	for {
+		body, err := s.readFrame(streamAAD)
+		if err != nil {
+			return fileReceipt{}, streamTrailer{}, fmt.Errorf("read chunk: %w", err)
+		}
+		pt, err := s.codec.decode(body)
+		if err != nil {
+			return fileReceipt{}, streamTrailer{}, fmt.Errorf("read chunk: %w", err)
+		}
+		if len(pt) == 0 {
+			break
+		}
+		h.Write(pt)
+		n += int64(len(pt))
+		if werr == nil {
+			_, werr = w.Write(pt)
+		}
+		prog.update(n)
+	}
+	var tr streamTrailer
+	if err := s.readJSON(&tr, "trailer"); err != nil {
+		return fileReceipt{}, streamTrailer{}, fmt.Errorf("read trailer: %w", err)
+	}
+	prog.finish()
+
+	r := fileReceipt{Received: n, Done: true, Hash: hex.EncodeToString(h.Sum(nil))}
+	switch {
+	case tr.Error != "":
+		r.Reason = fmt.Sprintf("sender could not read its input: %s", tr.Error)
+	case werr != nil:
+		r.Reason = fmt.Sprintf("write file: %v", werr)
+	case tr.Size != n || tr.Hash != r.Hash:
+		Printf("Verifying integrity (SHA-256) for %s... FAILED (expected %s, got %s)\n", name, tr.Hash, r.Hash)
+		r.Reason = fmt.Sprintf("hash mismatch: got %s (%d bytes), expected %s (%d bytes)", r.Hash, n, tr.Hash, tr.Size)
+	default:
+		Printf("Verifying integrity (SHA-256) for %s... OK\n", name)
+	}
+	return r, tr, nil
+}
+
+// orderedWriter adapts a plain writer to receiveChunks, which writes chunks at their offsets:
+// it accepts them only in order, and hashes what it writes.
+type orderedWriter struct {
+	w   io.Writer
+	h   hash.Hash
+	off int64
+}
+
+func (o *orderedWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off != o.off {
+		return 0, fmt.Errorf("chunk at %d out of order (expected %d)", off, o.off)
+	}
+	n, err := o.w.Write(p)
+	o.h.Write(p[:n])
+	o.off += int64(n)
+	return n, err
+}